@@ -0,0 +1,187 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"net/http"
+
+	"github.com/faryon93/handlers"
+	"github.com/gorilla/mux"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Route is an endpoint of the http api.
+type Route struct {
+	Method  string
+	Path    string
+	Summary string
+	Handler http.HandlerFunc
+	Scopes  []string
+
+	// the handler replays responses for retried requests
+	Idempotent bool
+	// documented query parameters
+	Query []string
+	// request body, success response and alternative 202 responses
+	Body     interface{}
+	Response interface{}
+	Accepted []interface{}
+	// the handler streams the response as server-sent events
+	Stream bool
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+// ApiRoutes are served under every api version.
+var ApiRoutes = []Route{
+	{
+		Method: http.MethodGet, Path: "/services",
+		Summary: "List the managed services",
+		Handler: ServiceList, Scopes: []string{ScopeRead},
+		Response: ServicesResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/service/{ServiceId}",
+		Summary: "Inspect a managed service",
+		Handler: ServiceGet, Scopes: []string{ScopeRead},
+		Response: ServiceResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/service/{ServiceId}",
+		Summary: "Deploy a new image to a service",
+		Handler: ServiceUpdate, Scopes: []string{ScopeDeploy}, Idempotent: true,
+		Body: UpdateBody{}, Response: UpdateResponse{},
+		Accepted: []interface{}{PendingResponse{}, QueuedResponse{}},
+	},
+	{
+		Method: http.MethodPost, Path: "/service/{ServiceId}/scale",
+		Summary: "Change the replica count of a service",
+		Handler: ServiceScale, Scopes: []string{ScopeScale}, Idempotent: true,
+		Body: ScaleBody{}, Response: ScaleResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/service/{ServiceId}/restart",
+		Summary: "Recycle all tasks of a service",
+		Handler: ServiceRestart, Scopes: []string{ScopeDeploy}, Idempotent: true,
+		Body: RestartBody{}, Response: RestartResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/freeze",
+		Summary: "Show the active deployment freeze",
+		Handler: FreezeGet, Scopes: []string{ScopeRead},
+		Response: FreezeResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/freeze",
+		Summary: "Freeze all deployments",
+		Handler: FreezeCreate, Scopes: []string{ScopeAdmin},
+		Body: FreezeBody{}, Response: FreezeResponse{},
+	},
+	{
+		Method: http.MethodDelete, Path: "/freeze",
+		Summary: "Lift the active deployment freeze",
+		Handler: FreezeDelete, Scopes: []string{ScopeAdmin},
+		Response: FreezeResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/events",
+		Summary: "Stream the progress of all deployments",
+		Handler: EventsStream, Scopes: []string{ScopeRead},
+		Response: Progress{}, Stream: true,
+	},
+	{
+		Method: http.MethodGet, Path: "/deployments/{DeploymentId}/events",
+		Summary: "Stream the progress of a single deployment",
+		Handler: DeploymentEventsStream, Scopes: []string{ScopeRead},
+		Response: Progress{}, Stream: true,
+	},
+	{
+		Method: http.MethodGet, Path: "/deployments",
+		Summary: "List deployments",
+		Handler: DeploymentList, Scopes: []string{ScopeRead, ScopeApprove},
+		Query:    []string{"state"},
+		Response: DeploymentsResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/deployments/{DeploymentId}/approve",
+		Summary: "Approve and execute a pending deployment",
+		Handler: DeploymentApprove, Scopes: []string{ScopeApprove},
+		Body: DecisionBody{}, Response: UpdateResponse{},
+		Accepted: []interface{}{QueuedResponse{}},
+	},
+	{
+		Method: http.MethodPost, Path: "/deployments/{DeploymentId}/deny",
+		Summary: "Deny a pending deployment",
+		Handler: DeploymentDeny, Scopes: []string{ScopeApprove},
+		Body: DecisionBody{}, Response: PendingResponse{},
+	},
+	{
+		Method: http.MethodGet, Path: "/log/level",
+		Summary: "Show the log level",
+		Handler: LogLevelGet, Scopes: []string{ScopeAdmin},
+		Response: LogLevelResponse{},
+	},
+	{
+		Method: http.MethodPut, Path: "/log/level",
+		Summary: "Change the log level",
+		Handler: LogLevelSet, Scopes: []string{ScopeAdmin},
+		Body: LogLevelBody{}, Response: LogLevelResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/secret/{Name}/rotate",
+		Summary: "Rotate a secret in all services using it",
+		Handler: SecretRotate, Scopes: []string{ScopeDeploy}, Idempotent: true,
+		Body: RotateBody{}, Response: RotateResponse{},
+	},
+	{
+		Method: http.MethodPost, Path: "/config/{Name}/rotate",
+		Summary: "Rotate a config in all services using it",
+		Handler: ConfigRotate, Scopes: []string{ScopeDeploy}, Idempotent: true,
+		Body: RotateBody{}, Response: RotateResponse{},
+	},
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// RegisterRoutes serves all api routes on r.
+// Strict routes validate request bodies against the api schema.
+func RegisterRoutes(r *mux.Router, strict bool) {
+	for _, route := range ApiRoutes {
+		var adapters []handlers.Adapter
+		if strict && route.Body != nil {
+			adapters = append(adapters, Validated(route.Body))
+		}
+		if route.Idempotent {
+			adapters = append(adapters, Idempotent())
+		}
+		adapters = append(adapters, Authorized(route.Scopes...))
+
+		r.Methods(route.Method).Path(route.Path).
+			Handler(handlers.ChainFunc(route.Handler, adapters...))
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/faryon93/util"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	LabelApproval = "whalepost.approval"
+
+	ApprovalRequired = "required"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// ApprovalError is returned when a deployment has been parked until approval.
+type ApprovalError struct {
+	*HttpError
+	Deployment Deployment
+}
+
+// DecisionBody is the approvers decision on a pending deployment.
+// The decision is recorded with the name of the approvers token.
+type DecisionBody struct {
+	Reason string `json:"reason" schema:"reason"`
+}
+
+// PendingResponse is returned when a deployment awaits approval.
+type PendingResponse struct {
+	Status     string     `json:"status"`
+	Deployment Deployment `json:"deployment"`
+}
+
+// DeploymentsResponse is the list of deployments.
+type DeploymentsResponse struct {
+	Status      string       `json:"status"`
+	Deployments []Deployment `json:"deployments"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// DeploymentList lists all deployments, optionally filtered by ?state=.
+func DeploymentList(w http.ResponseWriter, r *http.Request) {
+	util.Jsonify(w, DeploymentsResponse{
+		Status:      "success",
+		Deployments: ListDeployments(r.URL.Query().Get("state")),
+	})
+}
+
+// DeploymentApprove approves a pending deployment and executes it.
+func DeploymentApprove(w http.ResponseWriter, r *http.Request) {
+	decide(w, r, DeploymentApproved)
+}
+
+// DeploymentDeny denies a pending deployment.
+func DeploymentDeny(w http.ResponseWriter, r *http.Request) {
+	decide(w, r, DeploymentDenied)
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// requireApproval parks the deployment when the service requires an approval.
+func requireApproval(log *logrus.Entry, service *swarm.Service, body *UpdateBody) error {
+	if body.Approved || service.Spec.Labels[LabelApproval] != ApprovalRequired {
+		return nil
+	}
+
+	// retried requests must not create another pending deployment
+	d, ok := FindPending(service.Spec.Name, body)
+	if ok && d.Id != body.DeploymentId {
+		Publish(Progress{Type: ProgressResult, Deployment: body.DeploymentId, Service: service.Spec.Name,
+			State: DeploymentPending, Message: "superseded by " + d.Id})
+		removeDeployment(body.DeploymentId)
+	} else {
+		parked := *body
+		UpdateDeployment(body.DeploymentId, func(dep *Deployment) {
+			dep.State = DeploymentPending
+			expires := time.Now().Add(ApprovalTtl)
+			dep.Expires = &expires
+			dep.body = &parked
+			d = *dep
+		})
+
+		log.Infoln("deployment awaits approval")
+		notifyApprovers(log, &d)
+	}
+
+	return &ApprovalError{
+		HttpError:  NewHttpError(http.StatusAccepted, CodeApprovalRequired, "deployment awaits approval"),
+		Deployment: d,
+	}
+}
+
+// notifyApprovers tells the approvers about a pending deployment.
+func notifyApprovers(log *logrus.Entry, d *Deployment) {
+	log.WithField("deployment", d.Id).
+		Warnf("approval required for image \"%s\" until %s", d.Image, d.Expires.Format(time.RFC3339))
+
+	Notify(Event{
+		Event:      EventApproval,
+		Service:    d.Service,
+		Image:      d.Image,
+		Deployment: d.Id,
+		Message:    "approval required until " + d.Expires.Format(time.RFC3339),
+	})
+}
+
+// decide approves or denies a pending deployment.
+func decide(w http.ResponseWriter, r *http.Request, state string) {
+	id := mux.Vars(r)["DeploymentId"]
+	log := RequestLogger(r).
+		WithField("deployment", id)
+
+	// parse the request body
+	var body DecisionBody
+	err := util.ParseBody(r, &body)
+	if err != nil {
+		log.Warnln("failed to parse body:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidBody, "body: "+err.Error()))
+		return
+	}
+	d, found := GetDeployment(id)
+	if !found {
+		log.Warnln("no such deployment")
+		WriteError(w, r, NewHttpError(http.StatusNotFound, CodeDeploymentNotFound, "no such deployment"))
+		return
+	}
+	log = log.WithField("service", d.Service)
+
+	docker, err := NewDockerClient()
+	if err != nil {
+		log.Errorln("failed to create docker client:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusInternalServerError, CodeDockerClient, "failed to create docker client"))
+		return
+	}
+
+	// the approver has to be allowed to deploy the service as well
+	_, err = inspectAllowed(RequestContext(r), log, docker, d.Service)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	// only pending deployments can be decided exactly once
+	pending := false
+	found = UpdateDeployment(id, func(dep *Deployment) {
+		if dep.State != DeploymentPending {
+			return
+		}
+
+		now := time.Now()
+		dep.State = state
+		dep.DecidedBy = RequestToken(r).Name
+		dep.DecidedAt = &now
+		dep.Reason = body.Reason
+		d, pending = *dep, true
+	})
+	if !found {
+		log.Warnln("no such deployment")
+		WriteError(w, r, NewHttpError(http.StatusNotFound, CodeDeploymentNotFound, "no such deployment"))
+		return
+	}
+	if !pending {
+		log.Warnln("deployment is not pending")
+		WriteError(w, r, NewHttpError(http.StatusConflict, CodeDeploymentNotPending, "deployment is not pending"))
+		return
+	}
+
+	log.Infof("deployment %s by \"%s\"", state, d.DecidedBy)
+	if state != DeploymentApproved {
+		util.Jsonify(w, PendingResponse{Status: "success", Deployment: d})
+		return
+	}
+
+	update := *d.body
+	update.Approved = true
+	update.DeploymentId = d.Id
+	deployAndRespond(w, r, log, docker, d.Service, &update)
+}
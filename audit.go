@@ -0,0 +1,406 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faryon93/handlers"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	AuditAllowed   = "allowed"
+	AuditRejected  = "rejected"
+	AuditThrottled = "throttled"
+	AuditFailed    = "failed"
+
+	// maximum length of the recorded reason and error response
+	AuditReasonLength   = 256
+	auditResponseLength = 4096
+	auditRecordLength   = 1024 * 1024
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// AuditRecord is a line of the audit log. Every record contains
+// the hash of its predecessor, the hash of the record itself is
+// appended as last field.
+type AuditRecord struct {
+	Time     time.Time `json:"time"`
+	Request  string    `json:"request,omitempty"`
+	Token    string    `json:"token,omitempty"`
+	Addr     string    `json:"addr"`
+	Peer     string    `json:"peer,omitempty"`
+	Method   string    `json:"method"`
+	Route    string    `json:"route"`
+	Service  string    `json:"service,omitempty"`
+	Image    string    `json:"image,omitempty"`
+	Status   int       `json:"status"`
+	Decision string    `json:"decision"`
+	Code     string    `json:"code,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+	Prev     string    `json:"prev"`
+}
+
+// AuditLog is an append-only hash-chained JSON lines file.
+type AuditLog struct {
+	file  *os.File
+	last  string
+	size  int64
+	mutex sync.Mutex
+}
+
+// auditRecorder captures the status and error message of a response.
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+type auditKey struct{}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	Audit *AuditLog
+
+	// the hash is always the last field of a record
+	auditHashSuffix = regexp.MustCompile(`,"hash":"([0-9a-f]{64})"}$`)
+	auditGenesis    = strings.Repeat("0", 2*sha256.Size)
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// OpenAuditLog opens the audit log for appending and continues its hash chain.
+// A partial record left by an interrupted write is removed beforehand.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	err := repairAuditLog(path)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+
+	last, _, err := VerifyAuditLog(path)
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &AuditLog{file: file, last: last, size: info.Size()}, nil
+}
+
+// Write appends the record to the audit log and
+// flushes it to the disk before returning.
+func (a *AuditLog) Write(rec *AuditRecord) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	rec.Prev = a.last
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	hash := auditHash(rec.Prev, payload)
+	line := fmt.Sprintf("%s,\"hash\":\"%s\"}\n", payload[:len(payload)-1], hash)
+	n, err := a.file.WriteString(line)
+	if err == nil {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		// the chain continues at the previous record
+		a.file.Truncate(a.size)
+		return err
+	}
+
+	a.last, a.size = hash, a.size+int64(n)
+	return nil
+}
+
+// Close closes the audit log.
+func (a *AuditLog) Close() error {
+	return a.file.Close()
+}
+
+// VerifyAuditLog checks the hash chain of the audit log and returns
+// the hash of the last record and the number of records.
+func VerifyAuditLog(path string) (string, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return auditGenesis, 0, err
+	}
+	defer file.Close()
+
+	last, count := auditGenesis, 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), auditRecordLength)
+	for scanner.Scan() {
+		count++
+		line := scanner.Bytes()
+
+		match := auditHashSuffix.FindSubmatchIndex(line)
+		if match == nil {
+			return last, count, errors.Errorf("record %d: hash is missing", count)
+		}
+		hash := string(line[match[2]:match[3]])
+		payload := append(append([]byte{}, line[:match[0]]...), '}')
+
+		var rec AuditRecord
+		err := json.Unmarshal(payload, &rec)
+		if err != nil {
+			return last, count, errors.Wrapf(err, "record %d", count)
+		}
+		if rec.Prev != last {
+			return last, count, errors.Errorf("record %d: chain is broken", count)
+		}
+		if auditHash(rec.Prev, payload) != hash {
+			return last, count, errors.Errorf("record %d: hash mismatch", count)
+		}
+
+		last = hash
+	}
+
+	if err := scanner.Err(); err != nil {
+		return last, count, errors.Wrapf(err, "record %d", count+1)
+	}
+
+	return last, count, nil
+}
+
+// AuditCommand runs the audit subcommand and returns the exit code.
+func AuditCommand(args []string) int {
+	if len(args) != 2 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "usage: whalepost audit verify <file>")
+		return 2
+	}
+
+	_, count, err := VerifyAuditLog(args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "audit log is invalid:", err.Error())
+		return 1
+	}
+
+	fmt.Printf("audit log is valid: %d records\n", count)
+	return 0
+}
+
+// Audited writes an audit record for every api request.
+func Audited() handlers.Adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if Audit == nil || !strings.HasPrefix(r.URL.Path, "/api/") {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			rec := &AuditRecord{
+				Time:    time.Now(),
+				Request: RequestId(r),
+				Addr:    RemoteAddr(r),
+				Method:  r.Method,
+				Route:   r.URL.Path,
+			}
+			if peer := PeerAddr(r); peer != rec.Addr {
+				rec.Peer = peer
+			}
+
+			resp := &auditRecorder{ResponseWriter: w, status: http.StatusOK}
+			h.ServeHTTP(resp, r.WithContext(context.WithValue(r.Context(), auditKey{}, rec)))
+
+			rec.Status = resp.status
+			switch {
+			case resp.status >= http.StatusInternalServerError:
+				rec.Decision = AuditFailed
+			case resp.status == http.StatusTooManyRequests:
+				rec.Decision = AuditThrottled
+			case resp.status >= http.StatusBadRequest:
+				rec.Decision = AuditRejected
+			default:
+				rec.Decision = AuditAllowed
+			}
+			if resp.status >= http.StatusBadRequest {
+				var e ErrorResponse
+				if json.Unmarshal(resp.body.Bytes(), &e) == nil && e.Code != "" {
+					rec.Code, rec.Reason = e.Code, e.Message
+				} else {
+					rec.Reason = strings.TrimSpace(resp.body.String())
+				}
+				if len(rec.Reason) > AuditReasonLength {
+					rec.Reason = rec.Reason[:AuditReasonLength]
+				}
+			}
+
+			err := Audit.Write(rec)
+			if err != nil {
+				logrus.Errorln("failed to write audit record:", err.Error())
+			}
+		})
+	}
+}
+
+// AuditRequest adds the token and the route of the request to the audit record.
+func AuditRequest(r *http.Request, token *ApiToken) {
+	rec, ok := r.Context().Value(auditKey{}).(*AuditRecord)
+	if !ok {
+		return
+	}
+
+	if token != nil {
+		rec.Token = token.Name
+	}
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			rec.Route = tpl
+		}
+	}
+	if service, ok := mux.Vars(r)["ServiceId"]; ok {
+		rec.Service = service
+	}
+}
+
+// AuditImage adds the requested image to the audit record.
+func AuditImage(r *http.Request, image string) {
+	if rec, ok := r.Context().Value(auditKey{}).(*AuditRecord); ok {
+		rec.Image = image
+	}
+}
+
+// WriteHeader records the status code.
+func (a *auditRecorder) WriteHeader(status int) {
+	a.status = status
+	a.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the beginning of error messages.
+func (a *auditRecorder) Write(buf []byte) (int, error) {
+	if a.status >= http.StatusBadRequest && a.body.Len() < auditResponseLength {
+		n := auditResponseLength - a.body.Len()
+		if n > len(buf) {
+			n = len(buf)
+		}
+		a.body.Write(buf[:n])
+	}
+
+	return a.ResponseWriter.Write(buf)
+}
+
+// Flush passes the flush to event streams.
+func (a *auditRecorder) Flush() {
+	if flusher, ok := a.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// repairAuditLog removes a partial last record, which is left when whalepost
+// is interrupted while writing. A record which is only missing its line
+// break is kept. Records within the log are never modified.
+func repairAuditLog(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// the last line is at most as long as a record
+	size := info.Size()
+	tail := make([]byte, size)
+	if size > auditRecordLength+1 {
+		tail = make([]byte, auditRecordLength+1)
+	}
+	_, err = file.ReadAt(tail, size-int64(len(tail)))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(tail) == 0 || tail[len(tail)-1] == '\n' {
+		return nil
+	}
+
+	start := bytes.LastIndexByte(tail, '\n') + 1
+	if start == 0 && int64(len(tail)) < size {
+		return errors.New("last record is too long")
+	}
+
+	partial := tail[start:]
+	if auditHashSuffix.Match(partial) && json.Valid(partial) {
+		logrus.Warnln("audit log: completing last record")
+		_, err = file.WriteAt([]byte{'\n'}, size)
+	} else {
+		logrus.Warnf("audit log: removing partial last record of %d bytes", len(partial))
+		err = file.Truncate(size - int64(len(partial)))
+	}
+	if err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// auditHash chains the payload of a record to its predecessor.
+func auditHash(prev string, payload []byte) string {
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
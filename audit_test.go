@@ -0,0 +1,142 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestAuditLogChain(t *testing.T) {
+	path := testAuditLog(t, 3)
+
+	last, count, err := VerifyAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("count = %d, want 3", count)
+	}
+
+	// the chain continues after reopening
+	log, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log.last != last {
+		t.Errorf("last = %s, want %s", log.last, last)
+	}
+	log.Write(testAuditRecord())
+	log.Close()
+
+	if _, count, err := VerifyAuditLog(path); err != nil || count != 4 {
+		t.Errorf("count = %d, err = %v, want 4 records", count, err)
+	}
+}
+
+func TestAuditLogTornRecord(t *testing.T) {
+	path := testAuditLog(t, 2)
+	buf, _ := ioutil.ReadFile(path)
+
+	// the last record was interrupted while writing
+	torn := append(append([]byte{}, buf...), `{"time":"2026-10-19T12:00:00Z","addr":"10.0.0.1","meth`...)
+	ioutil.WriteFile(path, torn, 0600)
+
+	log, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("torn record prevents opening: %s", err)
+	}
+	log.Write(testAuditRecord())
+	log.Close()
+
+	if _, count, err := VerifyAuditLog(path); err != nil || count != 3 {
+		t.Errorf("count = %d, err = %v, want 3 records", count, err)
+	}
+}
+
+func TestAuditLogMissingNewline(t *testing.T) {
+	path := testAuditLog(t, 2)
+	buf, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, bytes.TrimSuffix(buf, []byte("\n")), 0600)
+
+	log, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+
+	// the complete record is kept
+	if _, count, err := VerifyAuditLog(path); err != nil || count != 2 {
+		t.Errorf("count = %d, err = %v, want 2 records", count, err)
+	}
+}
+
+func TestAuditLogModified(t *testing.T) {
+	path := testAuditLog(t, 2)
+	buf, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, bytes.Replace(buf, []byte("10.0.0.1"), []byte("10.0.0.2"), 1), 0600)
+
+	if _, err := OpenAuditLog(path); err == nil {
+		t.Error("modified audit log was opened")
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  helpers
+// ---------------------------------------------------------------------------------------
+
+// testAuditLog writes an audit log with count records.
+func testAuditLog(t *testing.T, count int) string {
+	dir, err := ioutil.TempDir("", "whalepost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "audit.jsonl")
+	log, err := OpenAuditLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+
+	for i := 0; i < count; i++ {
+		err := log.Write(testAuditRecord())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return path
+}
+
+func testAuditRecord() *AuditRecord {
+	return &AuditRecord{Time: time.Now(), Addr: "10.0.0.1", Method: "POST",
+		Route: "/api/v1/service/{ServiceId}/update", Status: 200, Decision: AuditAllowed}
+}
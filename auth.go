@@ -0,0 +1,331 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/faryon93/handlers"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	ScopeDeploy  = "deploy"
+	ScopeScale   = "scale"
+	ScopeRead    = "read"
+	ScopeApprove = "approve"
+	ScopeAdmin   = "admin"
+
+	// label set by docker stack deploy
+	LabelStackNamespace = "com.docker.stack.namespace"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// ApiToken is a named token with a set of scopes.
+// Empty restrictions allow all services, stacks and clusters.
+type ApiToken struct {
+	Name     string     `json:"name"`
+	Hash     string     `json:"hash"`
+	Scopes   []string   `json:"scopes"`
+	Services []string   `json:"services"`
+	Stacks   []string   `json:"stacks"`
+	Clusters []string   `json:"clusters"`
+	Expires  *time.Time `json:"expires"`
+
+	hash []byte
+}
+
+type tokenKey struct{}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	scopes = []string{ScopeDeploy, ScopeScale, ScopeRead, ScopeApprove, ScopeAdmin}
+	tokens []*ApiToken
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// SetupTokens validates the configured tokens and adds
+// the tokens given on the command line.
+func SetupTokens(confs []*ApiToken) error {
+	names := make(map[string]bool)
+	for _, token := range confs {
+		if token.Name == "" {
+			return errors.New("token name is missing")
+		}
+		if names[token.Name] {
+			return errors.Errorf("token \"%s\": duplicate name", token.Name)
+		}
+		names[token.Name] = true
+
+		hash, err := hex.DecodeString(strings.TrimPrefix(token.Hash, "sha256:"))
+		if err != nil || len(hash) != sha256.Size {
+			return errors.Errorf("token \"%s\": hash is not a sha256 hex digest", token.Name)
+		}
+		token.hash = hash
+
+		for _, scope := range token.Scopes {
+			if !containsString(scopes, scope) {
+				return errors.Errorf("token \"%s\": unknown scope \"%s\"", token.Name, scope)
+			}
+		}
+	}
+
+	tokens = confs
+	addLegacyToken("default", Token, ScopeDeploy, ScopeScale, ScopeRead)
+	addLegacyToken("read", ReadToken, ScopeRead)
+	addLegacyToken("approver", ApproverToken, ScopeApprove)
+	addLegacyToken("admin", AdminToken, ScopeAdmin)
+
+	return nil
+}
+
+// FindToken returns the token matching the given key.
+// Nil is returned if the key is unknown.
+func FindToken(key string) *ApiToken {
+	if key == "" {
+		return nil
+	}
+
+	hash := sha256.Sum256([]byte(key))
+	var match *ApiToken
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare(hash[:], token.hash) == 1 {
+			match = token
+		}
+	}
+
+	return match
+}
+
+// Authorized allows the request if it carries a valid token with one of the given scopes.
+// The token is passed to the handler in the request context.
+func Authorized(scopes ...string) handlers.Adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log := RequestLogger(r)
+			addr := RemoteAddr(r)
+			AuditRequest(r, nil)
+
+			// clients guessing tokens are locked out
+			if retry := CheckLockout(LimitIp, addr); retry > 0 {
+				log.Warnln("rejecting request: too many failed authentications")
+				WriteError(w, r, NewRateLimitError(LimitIp, CodeAuthLockedOut, "too many failed authentications", retry))
+				return
+			}
+
+			token, err := authenticate(requestKey(r))
+			if err != nil {
+				AuthFailed(LimitIp, addr)
+				log.Warnln("rejecting request:", err.Error())
+				WriteError(w, r, NewHttpError(http.StatusForbidden, CodeForbidden, "forbidden"))
+				return
+			}
+
+			log = log.WithField("token", token.Name)
+			AuditRequest(r, token)
+			if retry := CheckLockout(LimitToken, token.Name); retry > 0 {
+				log.Warnln("rejecting request: too many failed authentications")
+				WriteError(w, r, NewRateLimitError(LimitToken, CodeAuthLockedOut, "too many failed authentications", retry))
+				return
+			}
+
+			if token.IsExpired() {
+				AuthFailed(LimitIp, addr)
+				AuthFailed(LimitToken, token.Name)
+				log.Warnln("rejecting request: token expired")
+				WriteError(w, r, NewHttpError(http.StatusForbidden, CodeForbidden, "forbidden"))
+				return
+			}
+
+			// a valid token lacking permissions is not guessing, it must not lock itself out
+			if !token.HasAnyScope(scopes...) || !token.AllowsCluster(Cluster) {
+				log.Warnf("rejecting request: token lacks scope %s", strings.Join(scopes, " or "))
+				WriteError(w, r, NewHttpError(http.StatusForbidden, CodeForbidden, "forbidden"))
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), tokenKey{}, token)
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// RequestContext returns a background context carrying the
+// token and the client address of the request.
+func RequestContext(r *http.Request) context.Context {
+	return WithSource(WithToken(context.Background(), RequestToken(r)), RemoteAddr(r))
+}
+
+// RequestToken returns the token the request was authorized with.
+func RequestToken(r *http.Request) *ApiToken {
+	return ContextToken(r.Context())
+}
+
+// ContextToken returns the token stored in the context.
+func ContextToken(ctx context.Context) *ApiToken {
+	token, _ := ctx.Value(tokenKey{}).(*ApiToken)
+	return token
+}
+
+// WithToken returns a context carrying the token.
+func WithToken(ctx context.Context, token *ApiToken) context.Context {
+	if token == nil {
+		return ctx
+	}
+
+	return context.WithValue(ctx, tokenKey{}, token)
+}
+
+// RequestLogger returns the logger for the request.
+func RequestLogger(r *http.Request) *logrus.Entry {
+	addr, peer := RemoteAddr(r), PeerAddr(r)
+	log := logrus.WithField("addr", addr)
+	if id := RequestId(r); id != "" {
+		log = log.WithField("request", id)
+	}
+	if addr != peer {
+		log = log.WithField("peer", peer)
+	}
+	if token := RequestToken(r); token != nil {
+		log = log.WithField("token", token.Name)
+	}
+
+	return log
+}
+
+// HasScope returns true if the token grants the scope.
+// The admin scope grants all scopes.
+func (t *ApiToken) HasScope(scope string) bool {
+	return containsString(t.Scopes, scope) || containsString(t.Scopes, ScopeAdmin)
+}
+
+// HasAnyScope returns true if the token grants one of the scopes.
+func (t *ApiToken) HasAnyScope(scopes ...string) bool {
+	for _, scope := range scopes {
+		if t.HasScope(scope) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsExpired returns true if the token may not be used anymore.
+func (t *ApiToken) IsExpired() bool {
+	return t.Expires != nil && time.Now().After(*t.Expires)
+}
+
+// AllowsCluster returns true if the token may be used on the cluster.
+func (t *ApiToken) AllowsCluster(cluster string) bool {
+	return len(t.Clusters) == 0 || containsString(t.Clusters, cluster)
+}
+
+// AllowsService returns true if the token may be used for the service.
+// Service and stack restrictions support shell patterns.
+func (t *ApiToken) AllowsService(service *swarm.Service) bool {
+	if len(t.Services) > 0 && !matchAny(t.Services, service.Spec.Name) && !matchAny(t.Services, service.ID) {
+		return false
+	}
+
+	stack, ok := service.Spec.Labels[LabelStackNamespace]
+	if len(t.Stacks) > 0 && (!ok || !matchAny(t.Stacks, stack)) {
+		return false
+	}
+
+	return true
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// addLegacyToken adds a token given on the command line.
+func addLegacyToken(name, key string, scopes ...string) {
+	if key == "" {
+		return
+	}
+
+	hash := sha256.Sum256([]byte(key))
+	tokens = append(tokens, &ApiToken{Name: name, Scopes: scopes, hash: hash[:]})
+}
+
+// authenticate returns the token matching the key. JSON web tokens
+// are verified if trusted issuers are configured.
+func authenticate(key string) (*ApiToken, error) {
+	if len(issuers) > 0 && IsJwt(key) {
+		token, err := VerifyJwt(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid jwt")
+		}
+		return token, nil
+	}
+
+	token := FindToken(key)
+	if token == nil {
+		return nil, errors.New("invalid token")
+	}
+
+	return token, nil
+}
+
+// requestKey returns the key of the request taken from
+// the authorization header or the key parameter.
+func requestKey(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+
+	return r.URL.Query().Get("key")
+}
+
+// matchAny returns true if the value matches one of the patterns.
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+
+	return false
+}
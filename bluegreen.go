@@ -0,0 +1,217 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	LabelBlueGreenPeer    = "whalepost.bluegreen.peer"
+	LabelBlueGreenColor   = "whalepost.bluegreen.color"
+	LabelBlueGreenLive    = "whalepost.bluegreen.live"
+	LabelBlueGreenLabels  = "whalepost.bluegreen.labels"
+	LabelBlueGreenAliases = "whalepost.bluegreen.aliases"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// BlueGreenPair are two services of which only one receives traffic.
+type BlueGreenPair struct {
+	Live     *swarm.Service
+	Inactive *swarm.Service
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// IsBlueGreen returns true if the service is part of a blue/green pair.
+func IsBlueGreen(service *swarm.Service) bool {
+	return service.Spec.Labels[LabelBlueGreenPeer] != ""
+}
+
+// Color returns the color of the inactive service, which becomes live on switch.
+func (p *BlueGreenPair) Color() string {
+	return p.Inactive.Spec.Labels[LabelBlueGreenColor]
+}
+
+// Switch routes the traffic to the inactive service by swapping the routing
+// labels and network aliases between both services. Swapping the labels does
+// not touch the tasks, whereas swapping the aliases changes the task spec and
+// therefore replaces the tasks of both services. When the old live service
+// cannot be updated, the switch of the new one is reverted.
+func (p *BlueGreenPair) Switch(ctx context.Context, docker *client.Client) error {
+	opt := types.ServiceInspectOptions{}
+	live, _, err := docker.ServiceInspectWithRaw(ctx, p.Live.ID, opt)
+	if err != nil {
+		return err
+	}
+	inactive, _, err := docker.ServiceInspectWithRaw(ctx, p.Inactive.ID, opt)
+	if err != nil {
+		return err
+	}
+	// the labels might have been changed while the update was rolled out
+	if !isPaired(&live, &inactive) {
+		return NewHttpError(http.StatusConflict, CodeBlueGreenInvalid, "blue/green services are not peers of each other")
+	}
+	original, err := copyServiceSpec(&inactive.Spec)
+	if err != nil {
+		return err
+	}
+
+	// swap the routing labels
+	for _, key := range strings.Split(live.Spec.Labels[LabelBlueGreenLabels], ",") {
+		key = strings.TrimSpace(key)
+		if key == "" || IsProtectedLabel(key) {
+			continue
+		}
+
+		liveVal, liveOk := live.Spec.Labels[key]
+		inactiveVal, inactiveOk := inactive.Spec.Labels[key]
+		swapLabel(inactive.Spec.Labels, key, liveVal, liveOk)
+		swapLabel(live.Spec.Labels, key, inactiveVal, inactiveOk)
+	}
+
+	// swap the network aliases
+	if IsLabelEnabled(live.Spec.Labels, LabelBlueGreenAliases) {
+		for i := range live.Spec.TaskTemplate.Networks {
+			liveNet := &live.Spec.TaskTemplate.Networks[i]
+			for j := range inactive.Spec.TaskTemplate.Networks {
+				inactiveNet := &inactive.Spec.TaskTemplate.Networks[j]
+				if liveNet.Target == inactiveNet.Target {
+					liveNet.Aliases, inactiveNet.Aliases = inactiveNet.Aliases, liveNet.Aliases
+				}
+			}
+		}
+	}
+
+	inactive.Spec.Labels[LabelBlueGreenLive] = "true"
+	live.Spec.Labels[LabelBlueGreenLive] = "false"
+
+	// the new live service has to receive traffic before the old one is disabled
+	_, err = docker.ServiceUpdate(ctx, inactive.ID, inactive.Version, inactive.Spec, types.ServiceUpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	_, err = docker.ServiceUpdate(ctx, live.ID, live.Version, live.Spec, types.ServiceUpdateOptions{})
+	if err != nil {
+		errRevert := revertSpec(ctx, docker, inactive.ID, original)
+		if errRevert != nil {
+			return errors.Wrapf(err, "revert of \"%s\" failed: %s", inactive.Spec.Name, errRevert.Error())
+		}
+		return err
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// inspectPairLocked inspects and locks both services of a blue/green pair.
+func inspectPairLocked(ctx context.Context, log *logrus.Entry, docker *client.Client, service *swarm.Service) (*BlueGreenPair, func(), error) {
+	peer, err := inspectAllowed(ctx, log, docker, service.Spec.Labels[LabelBlueGreenPeer])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the services might have changed while waiting for the lock
+	unlock := LockServices(service.ID, peer.ID)
+	service, err = inspectAllowed(ctx, log, docker, service.ID)
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	peer, err = inspectAllowed(ctx, log, docker, peer.ID)
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+
+	// a misconfigured peer label must not swap the routing with an unrelated service
+	if !isPaired(service, peer) {
+		unlock()
+		log.Errorf("rejecting update: peer \"%s\" is not paired with the service", peer.Spec.Name)
+		return nil, nil, NewHttpError(http.StatusConflict, CodeBlueGreenInvalid, "blue/green services are not peers of each other")
+	}
+
+	// exactly one of both services is live
+	serviceLive := IsLabelEnabled(service.Spec.Labels, LabelBlueGreenLive)
+	peerLive := IsLabelEnabled(peer.Spec.Labels, LabelBlueGreenLive)
+	if serviceLive == peerLive {
+		unlock()
+		log.Errorln("rejecting update: blue/green pair has no distinct live service")
+		return nil, nil, NewHttpError(http.StatusConflict, CodeBlueGreenInvalid, "blue/green pair has no distinct live service")
+	}
+
+	if serviceLive {
+		return &BlueGreenPair{Live: service, Inactive: peer}, unlock, nil
+	}
+
+	return &BlueGreenPair{Live: peer, Inactive: service}, unlock, nil
+}
+
+// isPaired returns true if the peer labels of both services point to each other.
+func isPaired(a, b *swarm.Service) bool {
+	pointsTo := func(from, to *swarm.Service) bool {
+		peer := from.Spec.Labels[LabelBlueGreenPeer]
+		return from.ID != to.ID && (peer == to.ID || peer == to.Spec.Name)
+	}
+
+	return pointsTo(a, b) && pointsTo(b, a)
+}
+
+// revertSpec sets the spec of the service back to spec.
+func revertSpec(ctx context.Context, docker *client.Client, serviceId string, spec *swarm.ServiceSpec) error {
+	service, _, err := docker.ServiceInspectWithRaw(ctx, serviceId, types.ServiceInspectOptions{})
+	if err != nil {
+		return err
+	}
+
+	_, err = docker.ServiceUpdate(ctx, service.ID, service.Version, *spec, types.ServiceUpdateOptions{})
+	return err
+}
+
+// swapLabel sets or removes the label.
+func swapLabel(labels map[string]string, key, val string, ok bool) {
+	if ok {
+		labels[key] = val
+	} else {
+		delete(labels, key)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	LabelCanary       = "whalepost.canary"
+	LabelCanaryWindow = "whalepost.canary.window"
+	LabelCanaryProbe  = "whalepost.canary.probe"
+	LabelCanaryOf     = "whalepost.canary.of"
+
+	CanarySuffix        = "-canary"
+	CanaryProbeTimeout  = 5 * time.Second
+	CanaryProbeInterval = 10 * time.Second
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// IsCanaryEnabled returns true if updates of the service have to pass a canary.
+func IsCanaryEnabled(service *swarm.Service) bool {
+	return IsLabelEnabled(service.Spec.Labels, LabelCanary)
+}
+
+// RunCanary starts a single replica copy of the service with the new spec and
+// watches its health for the configured window. The canary is removed afterwards.
+// An error is returned when the canary turned out to be unhealthy.
+func RunCanary(ctx context.Context, log *logrus.Entry, docker *client.Client, service *swarm.Service, spec *swarm.ServiceSpec, opts types.ServiceUpdateOptions) error {
+	window := CanaryWindow
+	if val, ok := service.Spec.Labels[LabelCanaryWindow]; ok {
+		var err error
+		window, err = time.ParseDuration(val)
+		if err != nil {
+			return errors.Wrap(err, LabelCanaryWindow)
+		}
+	}
+
+	canary, err := canarySpec(service, spec)
+	if err != nil {
+		return err
+	}
+
+	// the name of the canary might be taken by a service not managed by whalepost
+	existing, _, err := docker.ServiceInspectWithRaw(ctx, canary.Name, types.ServiceInspectOptions{})
+	if err == nil && existing.Spec.Labels[LabelCanaryOf] != service.ID {
+		return NewHttpError(http.StatusConflict, CodeCanaryConflict,
+			fmt.Sprintf("service \"%s\" exists and is not a canary of this service", canary.Name))
+	} else if err != nil && !client.IsErrNotFound(err) {
+		return errors.Wrap(err, "inspect canary")
+	}
+
+	// a canary of a previous run might still be around
+	err = removeCanaries(ctx, docker, service.ID)
+	if err != nil {
+		return err
+	}
+
+	createOpts := types.ServiceCreateOptions{
+		EncodedRegistryAuth: opts.EncodedRegistryAuth,
+		QueryRegistry:       opts.QueryRegistry,
+	}
+	resp, err := docker.ServiceCreate(ctx, *canary, createOpts)
+	if err != nil {
+		return errors.Wrap(err, "create canary")
+	}
+	defer func() {
+		err := docker.ServiceRemove(context.Background(), resp.ID)
+		if err != nil {
+			log.Errorln("failed to remove canary:", err.Error())
+			return
+		}
+		log.Infoln("removed canary")
+	}()
+
+	log.Infof("started canary \"%s\", watching for %s", canary.Name, window)
+	return watchCanary(ctx, log, docker, resp.ID, window, service.Spec.Labels[LabelCanaryProbe])
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// canarySpec derives the spec of the canary from the new service spec.
+func canarySpec(service *swarm.Service, spec *swarm.ServiceSpec) (*swarm.ServiceSpec, error) {
+	// deep copy the spec in order to leave the original untouched
+	canary, err := copyServiceSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	// the canary must not be managed by whalepost
+	canary.Name = service.Spec.Name + CanarySuffix
+	canary.Labels = map[string]string{LabelCanaryOf: service.ID}
+
+	// a single replica which does not receive the traffic of the service: the canary
+	// publishes no ports and is only reachable on the networks of the service
+	replicas := uint64(1)
+	canary.Mode = swarm.ServiceMode{Replicated: &swarm.ReplicatedService{Replicas: &replicas}}
+	if canary.EndpointSpec != nil {
+		canary.EndpointSpec = &swarm.EndpointSpec{Mode: canary.EndpointSpec.Mode}
+	}
+
+	// restarts of the canary indicate a failure
+	canary.TaskTemplate.RestartPolicy = &swarm.RestartPolicy{Condition: swarm.RestartPolicyConditionNone}
+
+	return canary, nil
+}
+
+// removeCanaries removes all canaries of the service.
+func removeCanaries(ctx context.Context, docker *client.Client, serviceId string) error {
+	opts := types.ServiceListOptions{
+		Filters: filters.NewArgs(filters.Arg("label", LabelCanaryOf+"="+serviceId)),
+	}
+	canaries, err := docker.ServiceList(ctx, opts)
+	if err != nil {
+		return err
+	}
+
+	for _, canary := range canaries {
+		err := docker.ServiceRemove(ctx, canary.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// watchCanary waits for the canary task to run and makes sure it stays
+// healthy for the whole window. The probe url is checked periodically
+// during the window and at its end.
+func watchCanary(ctx context.Context, log *logrus.Entry, docker *client.Client, canaryId string, window time.Duration, probe string) error {
+	ticker := time.NewTicker(ConvergePollInterval)
+	defer ticker.Stop()
+
+	probeTicker := time.NewTicker(CanaryProbeInterval)
+	defer probeTicker.Stop()
+
+	timeout := time.After(ConvergeTimeout)
+	var deadline, probes <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout:
+			if deadline == nil {
+				return errors.New("canary did not start in time")
+			}
+		case <-deadline:
+			return probeCanary(probe)
+		case <-probes:
+			err := probeCanary(probe)
+			if err != nil {
+				return err
+			}
+		case <-ticker.C:
+		}
+
+		running, err := checkCanaryTasks(ctx, docker, canaryId)
+		if err != nil {
+			return err
+		}
+
+		// the window starts as soon as the canary is running
+		if running && deadline == nil {
+			deadline = time.After(window)
+			if probe != "" {
+				log.Infof("probing canary at %s", probe)
+				probes = probeTicker.C
+			}
+		}
+	}
+}
+
+// checkCanaryTasks returns true if the canary is running and
+// an error if the canary task failed or was restarted.
+func checkCanaryTasks(ctx context.Context, docker *client.Client, canaryId string) (bool, error) {
+	opts := types.TaskListOptions{Filters: filters.NewArgs(filters.Arg("service", canaryId))}
+	tasks, err := docker.TaskList(ctx, opts)
+	if err != nil {
+		return false, err
+	}
+
+	if len(tasks) > 1 {
+		return false, errors.New("canary has been restarted")
+	}
+
+	for _, task := range tasks {
+		switch task.Status.State {
+		case swarm.TaskStateFailed, swarm.TaskStateRejected,
+			swarm.TaskStateShutdown, swarm.TaskStateComplete:
+			return false, errors.Errorf("canary task %s: %s", task.Status.State, task.Status.Err)
+		case swarm.TaskStateRunning:
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// probeCanary sends a http request to the probe url if configured.
+func probeCanary(probe string) error {
+	if probe == "" {
+		return nil
+	}
+
+	client := http.Client{Timeout: CanaryProbeTimeout}
+	resp, err := client.Get(probe)
+	if err != nil {
+		return errors.Wrap(err, "canary probe")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return errors.Errorf("canary probe: unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,358 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	// max time of a single request to the docker daemon
+	CheckTimeout = 30 * time.Second
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// checkReport collects the outcome of all checks.
+type checkReport struct {
+	out      io.Writer
+	failures int
+	warnings int
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// CheckCommand validates the configuration given by the command line,
+// the docker endpoint and the registry credentials and returns the exit code.
+func CheckCommand(window, logFormat, logLevel string) int {
+	report := checkReport{out: os.Stdout}
+
+	report.check("command line options", checkOptions())
+	report.check("logging options", SetupLogging(logFormat, logLevel, false))
+	// problems are part of the report
+	logrus.SetOutput(ioutil.Discard)
+
+	report.checkConfig(window)
+	report.checkDocker()
+
+	fmt.Fprintf(report.out, "\n%d failed, %d warnings\n", report.failures, report.warnings)
+	if report.failures > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// checkConfig loads and validates all configuration files and options.
+func (r *checkReport) checkConfig(window string) {
+	for _, err := range SetupCredentials(ConfFile, ConfSet) {
+		if os.IsNotExist(errors.Cause(err)) && !isFlagSet("conf") {
+			r.warn("docker config %s not found: no registry credentials", ConfFile)
+		} else {
+			r.fail("docker config: %s", err.Error())
+		}
+	}
+	for _, name := range credentialSetNames() {
+		r.ok("credential set %s: %d registries", name, len(CredentialSets[name].Auths))
+	}
+	if Config == nil && isFlagSet("conf-default") {
+		r.fail("default credential set %s not found", ConfSet)
+	} else if Config == nil && len(CredentialSets) > 0 {
+		r.warn("default credential set %s not found: services need %s", ConfSet, LabelRegistryCredentials)
+	}
+
+	var err error
+
+	AppSettings = &Settings{}
+	if SettingsFile != "" {
+		settings, err := LoadSettings(SettingsFile)
+		r.check("settings "+SettingsFile, err)
+		if err == nil {
+			AppSettings = settings
+		}
+	}
+
+	err = SetupTokens(AppSettings.Tokens)
+	if err == nil {
+		err = SetupIssuers(AppSettings.Issuers)
+	}
+	if err == nil && len(tokens) == 0 && len(issuers) == 0 {
+		err = errors.New("none configured: use -token or the settings file")
+	}
+	if err != nil {
+		r.fail("tokens: %s", err.Error())
+	} else {
+		r.ok("tokens: %d tokens, %d issuers", len(tokens), len(issuers))
+	}
+	r.check(fmt.Sprintf("notifiers: %d notifiers", len(AppSettings.Notifiers)), SetupNotifiers(AppSettings.Notifiers))
+
+	if AuditFile != "" {
+		_, count, err := VerifyAuditLog(AuditFile)
+		created := os.IsNotExist(err)
+		if created {
+			_, err = os.Stat(filepath.Dir(AuditFile))
+		}
+
+		if err != nil {
+			r.fail("audit log %s: %s", AuditFile, err.Error())
+		} else if created {
+			r.ok("audit log %s: will be created", AuditFile)
+		} else {
+			r.ok("audit log %s: %d records", AuditFile, count)
+		}
+	}
+
+	_, err = ParseNets(AllowCidr)
+	r.check("allowed networks", err)
+	_, err = ParseNets(TrustedProxy)
+	r.check("trusted proxies", err)
+	if DeployRateLimit != "" {
+		_, err = ParseRate(DeployRateLimit)
+		r.check("deployment rate", err)
+	}
+	if window != "" {
+		GlobalWindow, err = ParseWindow(window)
+		r.check("deployment window", err)
+	}
+}
+
+// checkDocker verifies the docker endpoint, the managed services
+// and the registry credentials.
+func (r *checkReport) checkDocker() {
+	docker, err := NewDockerClient()
+	if err != nil {
+		r.fail("docker endpoint %s: %s", Endpoint, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CheckTimeout)
+	info, err := docker.Info(ctx)
+	cancel()
+	if err != nil {
+		r.fail("docker endpoint %s: %s", Endpoint, err.Error())
+		return
+	}
+	r.ok("docker endpoint %s: %s, docker %s", Endpoint, info.Name, info.ServerVersion)
+
+	if !info.Swarm.ControlAvailable {
+		r.fail("swarm: node %s is not a swarm manager (state %s)", info.Name, info.Swarm.LocalNodeState)
+	} else {
+		r.ok("swarm: node %s is a manager of %d nodes", info.Name, info.Swarm.Nodes)
+		r.checkServices(docker)
+	}
+
+	r.checkRegistries(docker)
+}
+
+// checkServices lists the services carrying the allow label and validates their labels.
+func (r *checkReport) checkServices(docker *client.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), CheckTimeout)
+	defer cancel()
+
+	opts := types.ServiceListOptions{Filters: filters.NewArgs(filters.Arg("label", LabelAllow))}
+	services, err := docker.ServiceList(ctx, opts)
+	if err != nil {
+		r.fail("services: %s", err.Error())
+		return
+	}
+
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Spec.Name < services[j].Spec.Name
+	})
+
+	enabled := 0
+	for _, service := range services {
+		labels := service.Spec.Labels
+		name := service.Spec.Name
+		if !IsLabelEnabled(labels, LabelAllow) {
+			r.warn("service %s: label %s is set to \"%s\"", name, LabelAllow, labels[LabelAllow])
+			continue
+		}
+
+		enabled++
+		container := service.Spec.TaskTemplate.ContainerSpec
+		if container == nil {
+			r.fail("service %s: service has no container spec", name)
+			continue
+		}
+		r.check(fmt.Sprintf("service %s: %s", name, container.Image), checkLabels(labels))
+	}
+
+	if enabled == 0 {
+		r.warn("services: no service carries the label %s", LabelAllow)
+	}
+}
+
+// checkRegistries logs in to every registry of all credential sets.
+func (r *checkReport) checkRegistries(docker *client.Client) {
+	for _, name := range credentialSetNames() {
+		auths := CredentialSets[name].Auths
+		indexes := make([]string, 0, len(auths))
+		for index := range auths {
+			indexes = append(indexes, index)
+		}
+		sort.Strings(indexes)
+
+		for _, index := range indexes {
+			ctx, cancel := context.WithTimeout(context.Background(), CheckTimeout)
+			_, err := docker.RegistryLogin(ctx, *auths[index])
+			cancel()
+
+			r.check(fmt.Sprintf("registry %s of %s: logged in as %s", index, name, auths[index].Username), err)
+		}
+	}
+}
+
+// check reports the outcome of a single check.
+func (r *checkReport) check(what string, err error) {
+	if err != nil {
+		r.fail("%s: %s", what, err.Error())
+		return
+	}
+
+	r.ok("%s", what)
+}
+
+// ok reports a passed check.
+func (r *checkReport) ok(format string, args ...interface{}) {
+	r.print("ok", format, args...)
+}
+
+// warn reports a problem which does not fail the check.
+func (r *checkReport) warn(format string, args ...interface{}) {
+	r.warnings++
+	r.print("warn", format, args...)
+}
+
+// fail reports a failed check, the command exits with an error.
+func (r *checkReport) fail(format string, args ...interface{}) {
+	r.failures++
+	r.print("fail", format, args...)
+}
+
+// print writes a line of the report prefixed by the status.
+func (r *checkReport) print(status, format string, args ...interface{}) {
+	fmt.Fprintf(r.out, "[%-4s] %s\n", status, fmt.Sprintf(format, args...))
+}
+
+// checkOptions validates the command line options.
+func checkOptions() error {
+	if Endpoint == "" || LabelAllow == "" || ApiVersion == "" {
+		return errors.New("-endpoint, -label and -api must not be empty")
+	}
+	if WindowMode != WindowModeReject && WindowMode != WindowModeQueue {
+		return errors.Errorf("invalid -window-mode \"%s\"", WindowMode)
+	}
+
+	return nil
+}
+
+// checkLabels validates the whalepost labels of a service.
+func checkLabels(labels map[string]string) error {
+	if expr, ok := labels[LabelWindow]; ok {
+		_, err := ParseWindow(expr)
+		if err != nil {
+			return errors.Wrap(err, LabelWindow)
+		}
+	}
+
+	if s, ok := labels[LabelDeployRate]; ok {
+		_, err := ParseRate(s)
+		if err != nil {
+			return errors.Wrap(err, LabelDeployRate)
+		}
+	}
+
+	if _, _, err := scaleLimits(labels); err != nil {
+		return err
+	}
+
+	if list, ok := labels[LabelAllowCidr]; ok {
+		_, err := ParseNets(list)
+		if err != nil {
+			return errors.Wrap(err, LabelAllowCidr)
+		}
+	}
+
+	if name, ok := labels[LabelRegistryCredentials]; ok {
+		if _, ok := CredentialSets[name]; !ok {
+			return errors.Wrap(ErrCredentialSetNotFound, LabelRegistryCredentials+": "+name)
+		}
+	}
+
+	if IsLabelEnabled(labels, LabelPoll) {
+		_, err := nextPoll(labels, time.Now())
+		if err != nil {
+			return errors.Wrap(err, LabelPoll)
+		}
+	}
+
+	return nil
+}
+
+// credentialSetNames returns the sorted names of all credential sets.
+func credentialSetNames() []string {
+	names := make([]string, 0, len(CredentialSets))
+	for name := range CredentialSets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// isFlagSet returns true if the flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+
+	return set
+}
@@ -0,0 +1,349 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+// exit codes of the deploy client
+const (
+	ExitSucceeded  = 0
+	ExitFailed     = 1
+	ExitUsage      = 2
+	ExitRejected   = 3
+	ExitRolledBack = 4
+	ExitTimeout    = 5
+)
+
+const (
+	ClientUrlEnv   = "WHALEPOST_URL"
+	ClientTokenEnv = "WHALEPOST_TOKEN"
+
+	ClientReconnectDelay = 2 * time.Second
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// deployClient talks to the http api of a whalepost server.
+type deployClient struct {
+	url   string
+	token string
+	json  bool
+	out   io.Writer
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// DeployCommand deploys an image to a service via the http api
+// and returns the exit code.
+func DeployCommand(args []string) int {
+	var (
+		c       = deployClient{out: os.Stdout}
+		service string
+		image   string
+		auth    bool
+		wait    bool
+		timeout time.Duration
+	)
+
+	flags := flag.NewFlagSet("deploy", flag.ContinueOnError)
+	flags.StringVar(&c.url, "url", os.Getenv(ClientUrlEnv), "url of the whalepost server [$"+ClientUrlEnv+"]")
+	flags.StringVar(&c.token, "token", os.Getenv(ClientTokenEnv), "token for authentication [$"+ClientTokenEnv+"]")
+	flags.StringVar(&service, "service", "", "name or id of the service")
+	flags.StringVar(&image, "image", "", "image to deploy")
+	flags.BoolVar(&auth, "auth", false, "send registry credentials to the swarm agents")
+	flags.BoolVar(&wait, "wait", false, "wait for the deployment to finish")
+	flags.DurationVar(&timeout, "timeout", 15*time.Minute, "max time to wait for the deployment")
+	flags.BoolVar(&c.json, "json", false, "print json instead of human readable output")
+	err := flags.Parse(args)
+	if err != nil {
+		return ExitUsage
+	}
+	if c.url == "" || c.token == "" || service == "" || image == "" || flags.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "usage: whalepost deploy --url <url> --token <token> --service <service> --image <image> [--wait] [--auth]")
+		flags.PrintDefaults()
+		return ExitUsage
+	}
+	c.url = strings.TrimSuffix(c.url, "/")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// the deployment is submitted in the background and followed by its event stream
+	body := map[string]interface{}{"image": image, "async": true}
+	flags.Visit(func(f *flag.Flag) {
+		// the service default applies unless given
+		if f.Name == "auth" {
+			body["auth"] = auth
+		}
+	})
+	var accepted PendingResponse
+	code := c.request(ctx, http.MethodPost, "/api/v2/service/"+url.PathEscape(service), body, &accepted)
+	if code != ExitSucceeded {
+		return code
+	}
+
+	d := accepted.Deployment
+	c.print(accepted, "deployment %s of %s accepted\n", d.Id, d.Image)
+	if !wait {
+		return ExitSucceeded
+	}
+
+	return c.follow(ctx, d.Id)
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// request sends a json request and decodes the response into v.
+func (c *deployClient) request(ctx context.Context, method, path string, body, v interface{}) int {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return c.fail(ExitFailed, err)
+	}
+
+	req, err := http.NewRequest(method, c.url+path, bytes.NewReader(buf))
+	if err != nil {
+		return c.fail(ExitUsage, err)
+	}
+	req.Header.Set("Content-Type", MediaTypeJson)
+	req.Header.Set(IdempotencyHeader, newId())
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return c.fail(exitCode(ctx, ExitFailed), err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return c.failResponse(resp)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		return c.fail(ExitFailed, errors.New("invalid response: "+err.Error()))
+	}
+
+	return ExitSucceeded
+}
+
+// follow prints the progress of the deployment until it is finished, which
+// is the case once the service has converged or the deployment failed.
+// Interrupted event streams are resumed until the timeout expires.
+func (c *deployClient) follow(ctx context.Context, id string) int {
+	for {
+		code, err := c.stream(ctx, id)
+		if err == nil {
+			return code
+		}
+		if ctx.Err() != nil {
+			return c.fail(exitCode(ctx, ExitFailed), err)
+		}
+
+		fmt.Fprintf(os.Stderr, "event stream interrupted, reconnecting: %s\n", err.Error())
+		select {
+		case <-ctx.Done():
+			return c.fail(exitCode(ctx, ExitFailed), ctx.Err())
+		case <-time.After(ClientReconnectDelay):
+		}
+	}
+}
+
+// stream prints the events of the deployment until its result and returns
+// the exit code. An error is returned if the stream has been interrupted.
+func (c *deployClient) stream(ctx context.Context, id string) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url+"/api/v2/deployments/"+url.PathEscape(id)+"/events", nil)
+	if err != nil {
+		return c.fail(ExitUsage, err), nil
+	}
+	req.Header.Set("Accept", MediaTypeEvent)
+
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return c.failResponse(resp), nil
+	}
+
+	// server-sent events are separated by empty lines
+	var data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "data:") {
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+			continue
+		}
+		if line != "" || data == "" {
+			continue
+		}
+
+		var p Progress
+		err := json.Unmarshal([]byte(data), &p)
+		data = ""
+		if err != nil {
+			return c.fail(ExitFailed, errors.New("invalid event: "+err.Error())), nil
+		}
+
+		c.printProgress(p)
+		if p.Type == ProgressResult {
+			return resultCode(p), nil
+		}
+	}
+
+	err = scanner.Err()
+	if err == nil {
+		err = errors.New("event stream closed before the deployment finished")
+	}
+	return 0, err
+}
+
+// do sends the authenticated request.
+func (c *deployClient) do(ctx context.Context, req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("User-Agent", AppName+"/"+AppVersion)
+
+	return http.DefaultClient.Do(req.WithContext(ctx))
+}
+
+// printProgress prints a single progress event.
+func (c *deployClient) printProgress(p Progress) {
+	switch p.Type {
+	case ProgressPhase:
+		c.print(p, "%s\n", p.Phase)
+	case ProgressTask:
+		c.print(p, "task %d %s: %s (desired %s) %s\n", p.Task.Slot, p.Task.Id, p.Task.State, p.Task.Desired, p.Task.Message)
+	case ProgressWarning:
+		c.print(p, "warning: %s\n", p.Message)
+	case ProgressResult:
+		if p.Message != "" {
+			c.print(p, "deployment %s %s: %s\n", p.Deployment, p.State, p.Message)
+		} else {
+			c.print(p, "deployment %s %s\n", p.Deployment, p.State)
+		}
+	}
+}
+
+// print writes v as json line or the formatted message.
+func (c *deployClient) print(v interface{}, format string, args ...interface{}) {
+	if c.json {
+		json.NewEncoder(c.out).Encode(v)
+		return
+	}
+
+	fmt.Fprintf(c.out, format, args...)
+}
+
+// failResponse prints the error response and returns the matching exit code.
+func (c *deployClient) failResponse(resp *http.Response) int {
+	var e ErrorResponse
+	err := json.NewDecoder(resp.Body).Decode(&e)
+	if err != nil || e.Code == "" {
+		e = ErrorResponse{Status: "error", Code: CodeInternal, Message: resp.Status}
+	}
+
+	code := ExitFailed
+	if resp.StatusCode < http.StatusInternalServerError {
+		code = ExitRejected
+	}
+	switch e.Code {
+	case CodeRolledBack:
+		code = ExitRolledBack
+	case CodeConvergeTimeout:
+		code = ExitTimeout
+	}
+
+	c.print(e, "deployment %s: %s (%s)\n", statusText(code), e.Message, e.Code)
+	return code
+}
+
+// fail prints a client side error and returns code.
+func (c *deployClient) fail(code int, err error) int {
+	c.print(ErrorResponse{Status: "error", Message: err.Error()},
+		"deployment %s: %s\n", statusText(code), err.Error())
+	return code
+}
+
+// resultCode returns the exit code of a finished deployment.
+func resultCode(p Progress) int {
+	switch {
+	case p.State == DeploymentSucceeded:
+		return ExitSucceeded
+	case p.Code == CodeRolledBack:
+		return ExitRolledBack
+	case p.Code == CodeConvergeTimeout:
+		return ExitTimeout
+	case p.State == DeploymentFailed:
+		return ExitFailed
+	default:
+		return ExitRejected
+	}
+}
+
+// exitCode reports errors caused by the expired timeout as timeout.
+func exitCode(ctx context.Context, code int) int {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ExitTimeout
+	}
+
+	return code
+}
+
+// statusText describes the exit code.
+func statusText(code int) string {
+	switch code {
+	case ExitRejected:
+		return "rejected"
+	case ExitRolledBack:
+		return "rolled back"
+	case ExitTimeout:
+		return "timed out"
+	case ExitUsage:
+		return "invalid"
+	default:
+		return "failed"
+	}
+}
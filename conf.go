@@ -25,21 +25,46 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/docker/docker/api/types"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 )
 
 // ---------------------------------------------------------------------------------------
-//  public functions
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	// selects the named credential set used for the service
+	LabelRegistryCredentials = "whalepost.registry.credentials"
+	// sends the registry credentials unless the request decides otherwise
+	LabelRegistryAuth = "whalepost.registry.auth"
+
+	ConfExtension = ".json"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
 // ---------------------------------------------------------------------------------------
 
 type Conf struct {
 	Auths map[string]*types.AuthConfig `json:"auths"`
 }
 
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	ErrCredentialsNotFound   = errors.New("credentials not found")
+	ErrCredentialSetNotFound = errors.New("credential set not found")
+
+	// the credential sets by file name without extension
+	CredentialSets map[string]*Conf
+)
+
 // ---------------------------------------------------------------------------------------
 //  public functions
 // ---------------------------------------------------------------------------------------
@@ -65,10 +90,13 @@ func LoadConf(path string) (*Conf, error) {
 
 	// parse the auth string into an *types.AuthConfig
 	for key, val := range conf.Auths {
+		if val == nil {
+			return nil, errors.Errorf("auth of %s is empty", key)
+		}
+
 		password, username, err := decodeAuth(val.Auth)
 		if err != nil {
-			logrus.Errorln("decode auth failed:", err.Error())
-			panic(err)
+			return nil, errors.Wrapf(err, "auth of %s", key)
 		}
 		conf.Auths[key].Auth = ""
 		conf.Auths[key].ServerAddress = key
@@ -79,13 +107,70 @@ func LoadConf(path string) (*Conf, error) {
 	return &conf, nil
 }
 
-// GetAuth returns the encoded authentican string for an index.
-func (c *Conf) GetAuth(index string) (string, error) {
-	auth, ok := c.Auths[index]
-	if !ok {
-		return "", errors.New("credentials not found")
+// LoadConfs loads a comma separated list of configuration files and directories
+// containing them. Every file is a credential set named after the file. Paths
+// and files which cannot be loaded are skipped, their errors are returned
+// along with all sets which have been loaded.
+func LoadConfs(paths string) (map[string]*Conf, []error) {
+	sets := make(map[string]*Conf)
+	var errs []error
+
+	for _, path := range strings.Split(paths, ",") {
+		files, err := confFiles(strings.TrimSpace(path))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, file := range files {
+			name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+			if _, ok := sets[name]; ok {
+				errs = append(errs, errors.Errorf("duplicate credential set \"%s\" in %s", name, file))
+				continue
+			}
+
+			conf, err := LoadConf(file)
+			if err != nil {
+				errs = append(errs, errors.Wrap(err, file))
+				continue
+			}
+			sets[name] = conf
+		}
+	}
+
+	return sets, errs
+}
+
+// SetupCredentials loads the credential sets and selects the default set,
+// which is used for services without a set of their own.
+func SetupCredentials(paths, defaultSet string) []error {
+	var errs []error
+	CredentialSets, errs = LoadConfs(paths)
+	Config = CredentialSets[defaultSet]
+	return errs
+}
+
+// GetCredentials returns the credentials for an index. The credential set
+// selected by the labels is searched before the default set. The sets of
+// other services are never used.
+func GetCredentials(labels map[string]string, index string) (*types.AuthConfig, error) {
+	if name, ok := labels[LabelRegistryCredentials]; ok {
+		set, ok := CredentialSets[name]
+		if !ok {
+			return nil, errors.Wrap(ErrCredentialSetNotFound, name)
+		}
+
+		auth, err := set.GetAuthConfig(index)
+		if err != ErrCredentialsNotFound {
+			return auth, err
+		}
 	}
 
+	return Config.GetAuthConfig(index)
+}
+
+// EncodeAuth returns the encoded authentican string of the credentials.
+func EncodeAuth(auth *types.AuthConfig) (string, error) {
 	buf, err := json.Marshal(auth)
 	if err != nil {
 		return "", err
@@ -94,10 +179,60 @@ func (c *Conf) GetAuth(index string) (string, error) {
 	return base64.URLEncoding.EncodeToString(buf), nil
 }
 
+// GetAuth returns the encoded authentican string for an index.
+func (c *Conf) GetAuth(index string) (string, error) {
+	auth, err := c.GetAuthConfig(index)
+	if err != nil {
+		return "", err
+	}
+
+	return EncodeAuth(auth)
+}
+
+// GetAuthConfig returns the credentials for an index.
+func (c *Conf) GetAuthConfig(index string) (*types.AuthConfig, error) {
+	if c == nil {
+		return nil, ErrCredentialsNotFound
+	}
+
+	auth, ok := c.Auths[index]
+	if !ok {
+		return nil, ErrCredentialsNotFound
+	}
+
+	return auth, nil
+}
+
 // ---------------------------------------------------------------------------------------
 //  private functions
 // ---------------------------------------------------------------------------------------
 
+// confFiles returns the configuration file or all configuration
+// files of the directory.
+func confFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ConfExtension {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+
+	return files, nil
+}
+
 // decodeAuth decodes a base64 encoded string and returns username and password
 func decodeAuth(authStr string) (string, string, error) {
 	if authStr == "" {
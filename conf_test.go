@@ -0,0 +1,121 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestLoadConfs(t *testing.T) {
+	dir := testConfDir(t, map[string]string{
+		"config.json": testConf("registry.example.com", "ci:default"),
+		"team-a.json": testConf("registry.example.com", "robot-a:secret"),
+		"team-b.json": `{"auths": {"registry.example.com": `,
+	})
+
+	sets, errs := LoadConfs(dir + "," + filepath.Join(dir, "missing.json"))
+	if len(errs) != 2 {
+		t.Errorf("errors = %v, want broken and missing file", errs)
+	}
+	if len(sets) != 2 || sets["config"] == nil || sets["team-a"] == nil {
+		t.Errorf("sets = %v, want config and team-a", sets)
+	}
+
+	// a set may only be defined once
+	_, errs = LoadConfs(dir + "," + filepath.Join(dir, "team-a.json"))
+	if len(errs) != 2 {
+		t.Errorf("errors = %v, want broken file and duplicate set", errs)
+	}
+}
+
+func TestGetCredentials(t *testing.T) {
+	dir := testConfDir(t, map[string]string{
+		"default.json": testConf("registry.example.com", "ci:default"),
+		"team-a.json":  testConf("registry.example.com", "robot-a:secret"),
+		"team-b.json":  testConf("ghcr.io", "robot-b:secret"),
+	})
+
+	tests := []struct {
+		name   string
+		set    string
+		labels map[string]string
+		index  string
+		user   string
+		err    error
+	}{
+		{"own set", "default", map[string]string{LabelRegistryCredentials: "team-a"}, "registry.example.com", "robot-a", nil},
+		{"default set", "default", nil, "registry.example.com", "ci", nil},
+		{"fallback to default set", "default", map[string]string{LabelRegistryCredentials: "team-b"}, "registry.example.com", "ci", nil},
+		{"other teams are not searched", "default", map[string]string{LabelRegistryCredentials: "team-a"}, "ghcr.io", "", ErrCredentialsNotFound},
+		{"no default set", "", nil, "registry.example.com", "", ErrCredentialsNotFound},
+		{"unknown set", "default", map[string]string{LabelRegistryCredentials: "team-c"}, "registry.example.com", "", ErrCredentialSetNotFound},
+	}
+
+	for _, test := range tests {
+		if errs := SetupCredentials(dir, test.set); len(errs) > 0 {
+			t.Fatal(errs)
+		}
+
+		auth, err := GetCredentials(test.labels, test.index)
+		if errors.Cause(err) != test.err {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+		} else if err == nil && auth.Username != test.user {
+			t.Errorf("%s: username = %s, want %s", test.name, auth.Username, test.user)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  helpers
+// ---------------------------------------------------------------------------------------
+
+// testConfDir writes the configuration files to a temporary directory.
+func testConfDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "whalepost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	for name, content := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+// testConf returns a docker config with the credentials for the registry.
+func testConf(index, credentials string) string {
+	return `{"auths": {"` + index + `": {"auth": "` + base64.StdEncoding.EncodeToString([]byte(credentials)) + `"}}}`
+}
@@ -0,0 +1,208 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Schedule is a parsed cron expression with the fields
+// minute, hour, day of month, month and day of week.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+}
+
+type cronField struct {
+	min, max int
+	names    []string
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	cronFields = []cronField{
+		{min: 0, max: 59},
+		{min: 0, max: 23},
+		{min: 1, max: 31},
+		{min: 1, max: 12, names: []string{"", "jan", "feb", "mar", "apr", "may", "jun",
+			"jul", "aug", "sep", "oct", "nov", "dec"}},
+		{min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+	}
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// ParseSchedule parses a cron expression like "*/15 8-16 * * mon-fri".
+func ParseSchedule(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != len(cronFields) {
+		return nil, errors.Errorf("cron: expected %d fields, got %d", len(cronFields), len(fields))
+	}
+
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		var err error
+		bits[i], err = parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, errors.Wrapf(err, "cron: field \"%s\"", field)
+		}
+	}
+
+	// sunday can be written as 0 or 7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &Schedule{
+		minute:  bits[0],
+		hour:    bits[1],
+		dom:     bits[2],
+		month:   bits[3],
+		dow:     bits[4],
+		domStar: fields[2] == "*",
+		dowStar: fields[4] == "*",
+	}, nil
+}
+
+// Match returns true if the schedule matches the minute of t.
+func (s *Schedule) Match(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 ||
+		s.hour&(1<<uint(t.Hour())) == 0 ||
+		s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	return s.matchDay(t)
+}
+
+// Next returns the first minute after t matching the schedule.
+// The zero time is returned if there is no match within five years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	end := t.AddDate(5, 0, 0)
+	for t.Before(end) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.Match(t):
+			if s.hour&(1<<uint(t.Hour())) == 0 || !s.matchDay(t) {
+				// the hour has to be computed locally, zones with offsets
+				// like +05:30 do not start their hours with utc hours
+				t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			} else {
+				t = t.Add(time.Minute)
+			}
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// matchDay returns true if the day of t matches the schedule.
+// Like in cron either of both day fields has to match when both are restricted.
+func (s *Schedule) matchDay(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+
+	return domMatch || dowMatch
+}
+
+// parseCronField parses a comma separated list of values, ranges and steps.
+func parseCronField(field string, spec cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, errors.New("invalid step")
+			}
+			part = part[:i]
+		}
+
+		start, end := spec.min, spec.max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			start, err = parseCronValue(bounds[0], spec)
+			if err != nil {
+				return 0, err
+			}
+			end = start
+			if len(bounds) == 2 {
+				end, err = parseCronValue(bounds[1], spec)
+				if err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				end = spec.max
+			}
+		}
+
+		if start > end {
+			return 0, errors.New("invalid range")
+		}
+		for i := start; i <= end; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+
+	return bits, nil
+}
+
+// parseCronValue parses a single number or name.
+func parseCronValue(val string, spec cronField) (int, error) {
+	for i, name := range spec.names {
+		if name != "" && strings.EqualFold(val, name) {
+			return i, nil
+		}
+	}
+
+	num, err := strconv.Atoi(val)
+	if err != nil || num < spec.min || num > spec.max {
+		return 0, errors.Errorf("value \"%s\" out of range", val)
+	}
+
+	return num, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"testing"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * foo *",
+	} {
+		if _, err := ParseSchedule(expr); err == nil {
+			t.Errorf("ParseSchedule(%q): expected error", expr)
+		}
+	}
+}
+
+func TestScheduleMatch(t *testing.T) {
+	tests := []struct {
+		expr  string
+		time  string
+		match bool
+	}{
+		{"* * * * *", "2018-12-24T13:37:00Z", true},
+		{"*/15 8-16 * * mon-fri", "2018-12-24T08:45:00Z", true},
+		{"*/15 8-16 * * mon-fri", "2018-12-24T08:46:00Z", false},
+		{"*/15 8-16 * * mon-fri", "2018-12-22T08:45:00Z", false},
+		{"0 0 * * 7", "2018-12-23T00:00:00Z", true},
+		{"0 0 * * 0", "2018-12-23T00:00:00Z", true},
+		{"0 0 1 jan *", "2019-01-01T00:00:00Z", true},
+		{"0 0 1 jan *", "2019-02-01T00:00:00Z", false},
+
+		// either day field matches when both are restricted
+		{"0 0 1 * mon", "2018-12-24T00:00:00Z", true},
+		{"0 0 1 * mon", "2018-12-01T00:00:00Z", true},
+		{"0 0 1 * mon", "2018-12-25T00:00:00Z", false},
+	}
+
+	for _, test := range tests {
+		schedule, err := ParseSchedule(test.expr)
+		if err != nil {
+			t.Fatalf("ParseSchedule(%q): %s", test.expr, err)
+		}
+
+		at, _ := time.Parse(time.RFC3339, test.time)
+		if schedule.Match(at) != test.match {
+			t.Errorf("%q.Match(%s) = %t, want %t", test.expr, test.time, !test.match, test.match)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	ist := time.FixedZone("IST", 5*3600+30*60)
+	nepal := time.FixedZone("NPT", 5*3600+45*60)
+
+	tests := []struct {
+		expr string
+		from time.Time
+		next time.Time
+	}{
+		{"*/15 * * * *", time.Date(2018, 12, 24, 13, 37, 12, 0, time.UTC), time.Date(2018, 12, 24, 13, 45, 0, 0, time.UTC)},
+		{"0 9 * * *", time.Date(2018, 12, 24, 9, 0, 0, 0, time.UTC), time.Date(2018, 12, 25, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2018, 12, 24, 13, 37, 0, 0, time.UTC), time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"30 8 * * mon", time.Date(2018, 12, 24, 8, 31, 0, 0, time.UTC), time.Date(2018, 12, 31, 8, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+
+		// hours of zones with a fractional offset do not start with utc hours
+		{"0 9 * * *", time.Date(2018, 12, 24, 8, 10, 0, 0, ist), time.Date(2018, 12, 24, 9, 0, 0, 0, ist)},
+		{"15 10 * * *", time.Date(2018, 12, 24, 8, 50, 0, 0, ist), time.Date(2018, 12, 24, 10, 15, 0, 0, ist)},
+		{"0 12 * * *", time.Date(2018, 12, 24, 11, 59, 0, 0, nepal), time.Date(2018, 12, 24, 12, 0, 0, 0, nepal)},
+	}
+
+	for _, test := range tests {
+		schedule, err := ParseSchedule(test.expr)
+		if err != nil {
+			t.Fatalf("ParseSchedule(%q): %s", test.expr, err)
+		}
+
+		next := schedule.Next(test.from)
+		if !next.Equal(test.next) {
+			t.Errorf("%q.Next(%s) = %s, want %s", test.expr, test.from, next, test.next)
+		}
+	}
+}
+
+func TestScheduleNextNever(t *testing.T) {
+	schedule, err := ParseSchedule("0 0 31 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := schedule.Next(time.Date(2018, 12, 24, 0, 0, 0, 0, time.UTC))
+	if !next.IsZero() {
+		t.Errorf("expected no match, got %s", next)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	DeploymentRunning   = "running"
+	DeploymentQueued    = "queued"
+	DeploymentPending   = "pending"
+	DeploymentApproved  = "approved"
+	DeploymentDenied    = "denied"
+	DeploymentExpired   = "expired"
+	DeploymentSucceeded = "succeeded"
+	DeploymentFailed    = "failed"
+	DeploymentRejected  = "rejected"
+	DeploymentCancelled = "cancelled"
+
+	// finished deployments are forgotten after this time
+	DeploymentRetention = 24 * time.Hour
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Deployment is a requested update of a service.
+type Deployment struct {
+	Id        string     `json:"id"`
+	Service   string     `json:"service"`
+	Image     string     `json:"image"`
+	State     string     `json:"state"`
+	Token     string     `json:"token,omitempty"`
+	Created   time.Time  `json:"created"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	DecidedBy string     `json:"decidedBy,omitempty"`
+	DecidedAt *time.Time `json:"decidedAt,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Code      string     `json:"code,omitempty"`
+
+	Result *UpdateResponse `json:"result,omitempty"`
+	body   *UpdateBody
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	deployments     = make(map[string]*Deployment)
+	deploymentMutex sync.Mutex
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewDeployment registers a new deployment of the service and returns a copy.
+func NewDeployment(service string, body *UpdateBody, state string) Deployment {
+	d := &Deployment{
+		Id:      newId(),
+		Service: service,
+		Image:   body.Image,
+		State:   state,
+		Created: time.Now(),
+		body:    body,
+	}
+	if body.Identity != nil {
+		d.Token = body.Identity.Name
+	}
+
+	deploymentMutex.Lock()
+	deployments[d.Id] = d
+	deploymentMutex.Unlock()
+
+	return *d
+}
+
+// GetDeployment returns a copy of the deployment with the given id.
+func GetDeployment(id string) (Deployment, bool) {
+	deploymentMutex.Lock()
+	defer deploymentMutex.Unlock()
+
+	expireDeployments()
+	d, ok := deployments[id]
+	if !ok {
+		return Deployment{}, false
+	}
+
+	return *d, true
+}
+
+// ListDeployments returns copies of all deployments in the given state,
+// ordered by creation time. An empty state matches all deployments.
+func ListDeployments(state string) []Deployment {
+	deploymentMutex.Lock()
+	defer deploymentMutex.Unlock()
+
+	expireDeployments()
+	list := make([]Deployment, 0, len(deployments))
+	for _, d := range deployments {
+		if state == "" || d.State == state {
+			list = append(list, *d)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+
+	return list
+}
+
+// FindPending returns the pending deployment of the service with the same request.
+func FindPending(service string, body *UpdateBody) (Deployment, bool) {
+	for _, d := range ListDeployments(DeploymentPending) {
+		if d.Service == service && isSameRequest(d.body, body) {
+			return d, true
+		}
+	}
+
+	return Deployment{}, false
+}
+
+// LastDeployment returns the last successful deployment of the service.
+func LastDeployment(service string) (Deployment, bool) {
+	var last Deployment
+	found := false
+	for _, d := range ListDeployments(DeploymentSucceeded) {
+		if d.Service == service && (!found || d.Finished.After(*last.Finished)) {
+			last, found = d, true
+		}
+	}
+
+	return last, found
+}
+
+// UpdateDeployment calls fn with the deployment while holding the lock.
+// False is returned if the deployment does not exist.
+func UpdateDeployment(id string, fn func(d *Deployment)) bool {
+	deploymentMutex.Lock()
+	defer deploymentMutex.Unlock()
+
+	expireDeployments()
+	d, ok := deployments[id]
+	if !ok {
+		return false
+	}
+
+	fn(d)
+	return true
+}
+
+// IsFinished returns true if the deployment reached a final state.
+func (d *Deployment) IsFinished() bool {
+	switch d.State {
+	case DeploymentDenied, DeploymentExpired, DeploymentSucceeded, DeploymentFailed, DeploymentRejected,
+		DeploymentCancelled:
+		return true
+	default:
+		return false
+	}
+}
+
+// ResultProgress returns the progress event describing the final state.
+func (d *Deployment) ResultProgress() Progress {
+	return Progress{
+		Type:       ProgressResult,
+		Deployment: d.Id,
+		Service:    d.Service,
+		State:      d.State,
+		Message:    d.Error,
+		Code:       d.Code,
+		Time:       time.Now(),
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// finishDeployment records the outcome of the deployment and publishes it.
+// Deployments awaiting an approval are not finished yet, deployments
+// refused by a client error are rejected.
+func finishDeployment(id string, result *UpdateResponse, err error) {
+	if _, ok := err.(*ApprovalError); ok {
+		return
+	}
+
+	var progress Progress
+	found := UpdateDeployment(id, func(d *Deployment) {
+		now := time.Now()
+		d.Finished = &now
+		d.Result = result
+		d.State = DeploymentSucceeded
+		if err != nil {
+			status, code := errorStatus(err)
+			d.State = DeploymentFailed
+			if status < http.StatusInternalServerError {
+				d.State = DeploymentRejected
+			}
+			d.Error = err.Error()
+			d.Code = code
+		}
+		progress = d.ResultProgress()
+	})
+
+	if found {
+		Publish(progress)
+	}
+}
+
+// isSameRequest returns true if both bodies request the same change of a service.
+// Whether the request is answered asynchronously does not matter.
+func isSameRequest(a, b *UpdateBody) bool {
+	if a == nil || b == nil || a.Restart != b.Restart || a.Rotation != b.Rotation {
+		return false
+	}
+
+	ca, cb := *a, *b
+	ca.Async, cb.Async = false, false
+	bufA, err := json.Marshal(&ca)
+	if err != nil {
+		return false
+	}
+	bufB, err := json.Marshal(&cb)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(bufA, bufB)
+}
+
+// removeDeployment forgets the deployment.
+func removeDeployment(id string) {
+	deploymentMutex.Lock()
+	delete(deployments, id)
+	deploymentMutex.Unlock()
+}
+
+// expireDeployments expires pending deployments and forgets old ones.
+// The caller must hold the deployment lock.
+func expireDeployments() {
+	now := time.Now()
+	for id, d := range deployments {
+		if d.State == DeploymentPending && d.Expires != nil && now.After(*d.Expires) {
+			d.State = DeploymentExpired
+		}
+
+		if d.IsFinished() && now.Sub(d.Created) > DeploymentRetention {
+			delete(deployments, id)
+		}
+	}
+}
+
+// newId returns a random identifier.
+func newId() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,187 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	ConvergePollInterval = 1 * time.Second
+)
+
+var (
+	ErrRolledBack = errors.New("update has been rolled back")
+	ErrPaused     = errors.New("update has been paused")
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewDockerClient returns a client for the configured docker endpoint.
+func NewDockerClient() (*client.Client, error) {
+	// TODO: choose api version automatically
+	return client.NewClientWithOpts(client.WithHost(Endpoint), client.WithVersion(ApiVersion))
+}
+
+// WaitConverged blocks until the last update of the service has been completed.
+// An error is returned if the update got paused or rolled back.
+func WaitConverged(ctx context.Context, docker *client.Client, serviceId string) error {
+	ticker := time.NewTicker(ConvergePollInterval)
+	defer ticker.Stop()
+
+	for {
+		converged, err := isConverged(ctx, docker, serviceId)
+		if err != nil || converged {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// waitConverged waits for the service to converge within the configured timeout.
+func waitConverged(ctx context.Context, log *logrus.Entry, docker *client.Client, serviceId string) error {
+	log.Infoln("waiting for service to converge")
+
+	ctx, cancel := context.WithTimeout(ctx, ConvergeTimeout)
+	defer cancel()
+
+	return convergeError(log, WaitConverged(ctx, docker, serviceId))
+}
+
+// convergeError converts the error of waiting for a service to converge
+// into the error reported to the user.
+func convergeError(log *logrus.Entry, err error) error {
+	if err == context.DeadlineExceeded {
+		log.Errorln("service did not converge in time")
+		return NewHttpError(http.StatusGatewayTimeout, CodeConvergeTimeout, "service did not converge in time")
+	} else if err == ErrRolledBack {
+		log.Errorln("service did not converge:", err.Error())
+		return &HttpError{Status: http.StatusBadGateway, Code: CodeRolledBack, Message: err.Error(), Err: err}
+	} else if err == ErrPaused {
+		log.Errorln("service did not converge:", err.Error())
+		return &HttpError{Status: http.StatusBadGateway, Code: CodeUpdatePaused, Message: err.Error(), Err: err}
+	} else if err != nil {
+		log.Errorln("failed to wait for service:", err.Error())
+		return NewDockerError(CodeServiceInspectFailed, "failed to wait for service", err)
+	}
+
+	return nil
+}
+
+// isConverged checks whether the last update of the service has been completed.
+func isConverged(ctx context.Context, docker *client.Client, serviceId string) (bool, error) {
+	opt := types.ServiceInspectOptions{}
+	service, _, err := docker.ServiceInspectWithRaw(ctx, serviceId, opt)
+	if err != nil {
+		return false, err
+	}
+
+	// the update status is reset by swarm on every update and stays
+	// empty until the orchestrator picked up the update or when no
+	// task has to be replaced
+	if service.UpdateStatus != nil {
+		switch service.UpdateStatus.State {
+		case swarm.UpdateStateCompleted:
+			return true, nil
+		case swarm.UpdateStatePaused:
+			return false, ErrPaused
+		case swarm.UpdateStateRollbackCompleted, swarm.UpdateStateRollbackPaused:
+			return false, ErrRolledBack
+		default:
+			return false, nil
+		}
+	}
+
+	// all tasks that should run are running with the current spec
+	opts := types.TaskListOptions{Filters: filters.NewArgs(
+		filters.Arg("service", serviceId),
+		filters.Arg("desired-state", string(swarm.TaskStateRunning)),
+	)}
+	tasks, err := docker.TaskList(ctx, opts)
+	if err != nil {
+		return false, err
+	}
+
+	for _, task := range tasks {
+		if task.Status.State != swarm.TaskStateRunning || !isCurrentSpec(&task, &service.Spec.TaskTemplate) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// copyServiceSpec returns a deep copy of the spec.
+func copyServiceSpec(spec *swarm.ServiceSpec) (*swarm.ServiceSpec, error) {
+	buf, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var copied swarm.ServiceSpec
+	err = json.Unmarshal(buf, &copied)
+	if err != nil {
+		return nil, err
+	}
+
+	return &copied, nil
+}
+
+// isCurrentSpec returns true if the task has been created from the given spec.
+func isCurrentSpec(task *swarm.Task, spec *swarm.TaskSpec) bool {
+	current, err := json.Marshal(spec)
+	if err != nil {
+		return false
+	}
+
+	actual, err := json.Marshal(task.Spec)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(current, actual)
+}
@@ -0,0 +1,249 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+// machine readable error codes
+const (
+	CodeInternal               = "internal_error"
+	CodeInvalidBody            = "invalid_body"
+	CodeInvalidRequest         = "invalid_request"
+	CodeInvalidLabel           = "invalid_label"
+	CodeForbidden              = "forbidden"
+	CodeSourceNotAllowed       = "source_not_allowed"
+	CodeTokenNotAllowed        = "token_not_allowed"
+	CodeAuthLockedOut          = "auth_locked_out"
+	CodeRateLimited            = "rate_limited"
+	CodeDockerClient           = "docker_client_failed"
+	CodeDockerError            = "docker_error"
+	CodeVersionConflict        = "version_conflict"
+	CodeServiceNotFound        = "service_not_found"
+	CodeServiceNotAllowed      = "service_not_allowed"
+	CodeServiceInspectFailed   = "service_inspect_failed"
+	CodeServiceUpdateFailed    = "service_update_failed"
+	CodeInvalidImage           = "invalid_image"
+	CodeRegistryAuthMissing    = "registry_auth_missing"
+	CodeMutationNotAllowed     = "mutation_not_allowed"
+	CodeMutationFailed         = "mutation_failed"
+	CodeUpdateConfigNotAllowed = "update_config_not_allowed"
+	CodeCanaryFailed           = "canary_failed"
+	CodeCanaryConflict         = "canary_conflict"
+	CodeConvergeTimeout        = "converge_timeout"
+	CodeRolledBack             = "rolled_back"
+	CodeUpdatePaused           = "update_paused"
+	CodeBlueGreenInvalid       = "bluegreen_pair_invalid"
+	CodeBlueGreenSwitchFailed  = "bluegreen_switch_failed"
+	CodeWindowClosed           = "window_closed"
+	CodeDeploymentsFrozen      = "deployments_frozen"
+	CodeApprovalRequired       = "approval_required"
+	CodeDeploymentNotFound     = "deployment_not_found"
+	CodeDeploymentNotPending   = "deployment_not_pending"
+	CodeGlobalService          = "global_service"
+	CodeReplicasOutOfRange     = "replicas_out_of_range"
+	CodeObjectNotFound         = "object_not_found"
+	CodeIdempotencyMismatch    = "idempotency_key_reused"
+	CodeIdempotencyInProgress  = "idempotency_key_in_progress"
+	CodeStreamingUnsupported   = "streaming_unsupported"
+	CodeUnsupportedMediaType   = "unsupported_media_type"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// HttpError is an error which is reported to the user with a status code.
+type HttpError struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error
+}
+
+// ErrorResponse is returned to the user upon failure.
+type ErrorResponse struct {
+	Status    string `json:"status"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestId string `json:"requestId,omitempty"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+// ErrorCodes lists all machine readable error codes.
+var ErrorCodes = []string{
+	CodeInternal,
+	CodeInvalidBody,
+	CodeInvalidRequest,
+	CodeInvalidLabel,
+	CodeForbidden,
+	CodeSourceNotAllowed,
+	CodeTokenNotAllowed,
+	CodeAuthLockedOut,
+	CodeRateLimited,
+	CodeDockerClient,
+	CodeDockerError,
+	CodeVersionConflict,
+	CodeServiceNotFound,
+	CodeServiceNotAllowed,
+	CodeServiceInspectFailed,
+	CodeServiceUpdateFailed,
+	CodeInvalidImage,
+	CodeRegistryAuthMissing,
+	CodeMutationNotAllowed,
+	CodeMutationFailed,
+	CodeUpdateConfigNotAllowed,
+	CodeCanaryFailed,
+	CodeCanaryConflict,
+	CodeConvergeTimeout,
+	CodeRolledBack,
+	CodeUpdatePaused,
+	CodeBlueGreenInvalid,
+	CodeBlueGreenSwitchFailed,
+	CodeWindowClosed,
+	CodeDeploymentsFrozen,
+	CodeApprovalRequired,
+	CodeDeploymentNotFound,
+	CodeDeploymentNotPending,
+	CodeGlobalService,
+	CodeReplicasOutOfRange,
+	CodeObjectNotFound,
+	CodeIdempotencyMismatch,
+	CodeIdempotencyInProgress,
+	CodeStreamingUnsupported,
+	CodeUnsupportedMediaType,
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewHttpError creates a new error with the given status code.
+func NewHttpError(status int, code, message string) *HttpError {
+	return &HttpError{Status: status, Code: code, Message: message}
+}
+
+// NewDockerError wraps an error of the docker daemon. Updates of
+// outdated service versions are reported as conflict.
+func NewDockerError(code, message string, err error) *HttpError {
+	if strings.Contains(err.Error(), "update out of sequence") {
+		return &HttpError{Status: http.StatusConflict, Code: CodeVersionConflict,
+			Message: "service has been modified concurrently", Err: err}
+	}
+
+	return &HttpError{Status: http.StatusBadGateway, Code: code, Message: message, Err: err}
+}
+
+// Error returns the message of the error.
+func (e *HttpError) Error() string {
+	return e.Message
+}
+
+// WriteError writes the error to the client. Errors which are not
+// an *HttpError are reported as internal server error.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	switch e := err.(type) {
+	case *HttpError:
+		writeError(w, r, e)
+		return
+
+	case *ApprovalError:
+		writeJson(w, e.Status, PendingResponse{Status: "pending", Deployment: e.Deployment})
+		return
+
+	case *RateLimitError:
+		retry := int(math.Ceil(e.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		writeError(w, r, e.HttpError)
+		return
+
+	case *WindowError:
+		if !e.Opens.IsZero() {
+			retry := int(time.Until(e.Opens).Seconds()) + 1
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+		}
+		writeError(w, r, e.HttpError)
+		return
+	}
+
+	writeError(w, r, NewHttpError(http.StatusInternalServerError, CodeInternal, "internal server error"))
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// errorStatus returns the status code and error code reported for err.
+func errorStatus(err error) (int, string) {
+	switch e := err.(type) {
+	case *HttpError:
+		return e.Status, e.Code
+	case *ApprovalError:
+		return e.Status, e.Code
+	case *RateLimitError:
+		return e.Status, e.Code
+	case *WindowError:
+		return e.Status, e.Code
+	}
+
+	return http.StatusInternalServerError, CodeInternal
+}
+
+// writeError writes the error response.
+func writeError(w http.ResponseWriter, r *http.Request, e *HttpError) {
+	code := e.Code
+	if code == "" {
+		code = CodeInternal
+	}
+
+	writeJson(w, e.Status, ErrorResponse{
+		Status:    "error",
+		Code:      code,
+		Message:   e.Message,
+		RequestId: RequestId(r),
+	})
+}
+
+// writeJson writes the JSON representation of v with the given status code.
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
@@ -0,0 +1,296 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	ProgressPhase   = "phase"
+	ProgressTask    = "task"
+	ProgressWarning = "warning"
+	ProgressResult  = "result"
+
+	PhaseInspect   = "inspect"
+	PhaseRegistry  = "registry resolve"
+	PhaseCanary    = "canary"
+	PhaseSubmitted = "update submitted"
+	PhaseConverged = "converged"
+
+	EventBufferSize   = 64
+	EventKeepAlive    = 15 * time.Second
+	EventStreamHeader = "text/event-stream"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Progress is a live update about a running deployment.
+type Progress struct {
+	Type       string        `json:"type"`
+	Deployment string        `json:"deployment"`
+	Service    string        `json:"service"`
+	Phase      string        `json:"phase,omitempty"`
+	Task       *TaskProgress `json:"task,omitempty"`
+	Message    string        `json:"message,omitempty"`
+	State      string        `json:"state,omitempty"`
+	Code       string        `json:"code,omitempty"`
+	Time       time.Time     `json:"time"`
+}
+
+// TaskProgress is the state change of a single task.
+type TaskProgress struct {
+	Id      string `json:"id"`
+	Slot    int    `json:"slot,omitempty"`
+	Node    string `json:"node,omitempty"`
+	State   string `json:"state"`
+	Desired string `json:"desired"`
+	Message string `json:"message,omitempty"`
+}
+
+type subscriber struct {
+	deployment string
+	events     chan Progress
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	subscribers      = make(map[*subscriber]bool)
+	subscribersMutex sync.Mutex
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// Publish sends the progress to all subscribers.
+func Publish(p Progress) {
+	p.Time = time.Now()
+
+	subscribersMutex.Lock()
+	defer subscribersMutex.Unlock()
+
+	for sub := range subscribers {
+		if sub.deployment != "" && sub.deployment != p.Deployment {
+			continue
+		}
+
+		// slow subscribers must not block the deployment
+		select {
+		case sub.events <- p:
+		default:
+		}
+	}
+}
+
+// EventsStream streams the progress of all deployments.
+func EventsStream(w http.ResponseWriter, r *http.Request) {
+	stream(w, r, "")
+}
+
+// DeploymentEventsStream streams the progress of a single deployment.
+func DeploymentEventsStream(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["DeploymentId"]
+	if _, ok := GetDeployment(id); !ok {
+		WriteError(w, r, NewHttpError(http.StatusNotFound, CodeDeploymentNotFound, "no such deployment"))
+		return
+	}
+
+	stream(w, r, id)
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// subscribe registers a new subscriber for the deployment.
+// An empty deployment subscribes to all deployments.
+func subscribe(deployment string) (*subscriber, func()) {
+	sub := &subscriber{deployment: deployment, events: make(chan Progress, EventBufferSize)}
+
+	subscribersMutex.Lock()
+	subscribers[sub] = true
+	subscribersMutex.Unlock()
+
+	return sub, func() {
+		subscribersMutex.Lock()
+		delete(subscribers, sub)
+		subscribersMutex.Unlock()
+	}
+}
+
+// stream writes the progress as server-sent events until the client disconnects.
+// Streams of a single deployment end with its result.
+func stream(w http.ResponseWriter, r *http.Request, deployment string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		WriteError(w, r, NewHttpError(http.StatusInternalServerError, CodeStreamingUnsupported, "streaming not supported"))
+		return
+	}
+
+	sub, unsubscribe := subscribe(deployment)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", EventStreamHeader)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// the deployment might already be finished
+	if deployment != "" {
+		d, _ := GetDeployment(deployment)
+		if d.IsFinished() {
+			writeEvent(w, d.ResultProgress())
+			flusher.Flush()
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(EventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+
+		case p := <-sub.events:
+			writeEvent(w, p)
+			flusher.Flush()
+
+			if deployment != "" && p.Type == ProgressResult {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes a single server-sent event.
+func writeEvent(w http.ResponseWriter, p Progress) {
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return
+	}
+
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", p.Type, buf)
+}
+
+// publishPhase publishes that the deployment entered a new phase.
+func publishPhase(deployment, service, phase string) {
+	Publish(Progress{Type: ProgressPhase, Deployment: deployment, Service: service, Phase: phase})
+}
+
+// watchTasks publishes the state changes of all tasks of the service
+// until the service has converged and returns the outcome of the rollout.
+// Tasks which already ended before the update are not reported.
+func watchTasks(log *logrus.Entry, docker *client.Client, deployment, service, serviceId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ConvergeTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(ConvergePollInterval)
+	defer ticker.Stop()
+
+	states := make(map[string]swarm.TaskState)
+	first := true
+	for {
+		opts := types.TaskListOptions{Filters: filters.NewArgs(filters.Arg("service", serviceId))}
+		tasks, err := docker.TaskList(ctx, opts)
+		if err == nil {
+			for _, task := range tasks {
+				if states[task.ID] == task.Status.State {
+					continue
+				}
+				states[task.ID] = task.Status.State
+
+				// the history of the service is not part of the deployment
+				if first && isTaskEnded(task.Status.State) {
+					continue
+				}
+
+				Publish(Progress{
+					Type:       ProgressTask,
+					Deployment: deployment,
+					Service:    service,
+					Task: &TaskProgress{
+						Id:      task.ID,
+						Slot:    task.Slot,
+						Node:    task.NodeID,
+						State:   string(task.Status.State),
+						Desired: string(task.DesiredState),
+						Message: task.Status.Message,
+					},
+				})
+			}
+			first = false
+		}
+
+		converged, err := isConverged(ctx, docker, serviceId)
+		if err != nil {
+			return convergeError(log, err)
+		} else if converged {
+			publishPhase(deployment, service, PhaseConverged)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return convergeError(log, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// isTaskEnded returns true if the task will not run anymore.
+func isTaskEnded(state swarm.TaskState) bool {
+	switch state {
+	case swarm.TaskStateComplete, swarm.TaskStateShutdown, swarm.TaskStateFailed,
+		swarm.TaskStateRejected, swarm.TaskStateRemove, swarm.TaskStateOrphaned:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/faryon93/util"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Freeze blocks all deployments until it expires.
+type Freeze struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+// FreezeBody is the users request to freeze deployments.
+type FreezeBody struct {
+	Reason  string `json:"reason" schema:"reason"`
+	Expires string `json:"expires" schema:"expires"`
+}
+
+// FreezeResponse is returned to the user upon success.
+type FreezeResponse struct {
+	Status string  `json:"status"`
+	Freeze *Freeze `json:"freeze"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	freeze      *Freeze
+	freezeMutex sync.Mutex
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// GetFreeze returns the active freeze or nil.
+func GetFreeze() *Freeze {
+	freezeMutex.Lock()
+	defer freezeMutex.Unlock()
+
+	if freeze != nil && time.Now().After(freeze.Until) {
+		freeze = nil
+	}
+
+	return freeze
+}
+
+// FreezeGet returns the active freeze.
+func FreezeGet(w http.ResponseWriter, r *http.Request) {
+	util.Jsonify(w, FreezeResponse{Status: "success", Freeze: GetFreeze()})
+}
+
+// FreezeCreate freezes all deployments.
+func FreezeCreate(w http.ResponseWriter, r *http.Request) {
+	log := RequestLogger(r)
+
+	// parse the request body
+	var body FreezeBody
+	err := util.ParseBody(r, &body)
+	if err != nil {
+		log.Warnln("failed to parse body:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidBody, "body: "+err.Error()))
+		return
+	}
+
+	// the expiry is either a duration or a point in time
+	now := time.Now()
+	until, err := time.Parse(time.RFC3339, body.Expires)
+	if err != nil {
+		duration, err := time.ParseDuration(body.Expires)
+		if err != nil || duration <= 0 {
+			log.Warnln("rejecting freeze: invalid expiry")
+			WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidRequest, "expires: duration or RFC3339 time required"))
+			return
+		}
+		until = now.Add(duration)
+	} else if !until.After(now) {
+		log.Warnln("rejecting freeze: expiry in the past")
+		WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidRequest, "expires: must be in the future"))
+		return
+	}
+
+	if body.Reason == "" {
+		log.Warnln("rejecting freeze: reason missing")
+		WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidRequest, "reason: required"))
+		return
+	}
+
+	freezeMutex.Lock()
+	freeze = &Freeze{Reason: body.Reason, Since: now, Until: until}
+	freezeMutex.Unlock()
+
+	log.Infof("deployments frozen until %s: %s", until.Format(time.RFC3339), body.Reason)
+	util.Jsonify(w, FreezeResponse{Status: "success", Freeze: GetFreeze()})
+}
+
+// FreezeDelete lifts the active freeze.
+func FreezeDelete(w http.ResponseWriter, r *http.Request) {
+	freezeMutex.Lock()
+	freeze = nil
+	freezeMutex.Unlock()
+
+	// deployments queued by the freeze have to be requested again
+	cancelFrozenDeploys("deployment freeze lifted")
+
+	RequestLogger(r).Infoln("deployment freeze lifted")
+	util.Jsonify(w, FreezeResponse{Status: "success"})
+}
@@ -0,0 +1,291 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/faryon93/handlers"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	IdempotencyHeader = "Idempotency-Key"
+	ReplayedHeader    = "Idempotent-Replayed"
+
+	// maximum number of remembered responses
+	IdempotencyEntries = 10000
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// storedResponse is the remembered response of an idempotent request.
+type storedResponse struct {
+	hash    [sha256.Size]byte
+	done    bool
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// responseRecorder captures the response while writing it to the client.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	// delivery ids of known webhook senders
+	deliveryHeaders = []string{
+		IdempotencyHeader,
+		"X-GitHub-Delivery",
+		"X-Gitlab-Event-UUID",
+		"X-Gitea-Delivery",
+		"X-Gogs-Delivery",
+		"X-Request-UUID",
+	}
+
+	responses     = make(map[string]*storedResponse)
+	responseMutex sync.Mutex
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// Idempotent replays the stored response for retried requests
+// carrying the same idempotency key or delivery id.
+// Requests reusing a key with a different body are rejected.
+func Idempotent() handlers.Adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := IdempotencyKey(r)
+			if key == "" || IdempotencyTtl <= 0 {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			log := RequestLogger(r).WithField("idempotency", key)
+			buf, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				log.Warnln("failed to read body:", err.Error())
+				WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidBody, "body: "+err.Error()))
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(buf))
+
+			// keys are scoped to the token and the route
+			if token := RequestToken(r); token != nil {
+				key = token.Name + "\x00" + key
+			}
+			key = r.Method + " " + r.URL.Path + "\x00" + key
+			hash := requestHash(r, buf)
+
+			stored, owner := claimResponse(key, hash)
+			if !owner {
+				if stored.hash != hash {
+					log.Warnln("rejecting request: idempotency key reused with a different request")
+					WriteError(w, r, NewHttpError(http.StatusUnprocessableEntity, CodeIdempotencyMismatch,
+						"idempotency key reused with a different request"))
+					return
+				}
+
+				if !stored.done {
+					log.Warnln("rejecting request: request with the same idempotency key in progress")
+					WriteError(w, r, NewHttpError(http.StatusConflict, CodeIdempotencyInProgress,
+						"request with the same idempotency key in progress"))
+					return
+				}
+
+				log.Infoln("replaying stored response")
+				for name, values := range stored.header {
+					w.Header()[name] = values
+				}
+				w.Header().Set(ReplayedHeader, "true")
+				w.WriteHeader(stored.status)
+				w.Write(stored.body)
+				return
+			}
+
+			// a panicking handler must not block the key forever
+			rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+			completed := false
+			defer func() {
+				if !completed {
+					forgetResponse(key)
+				}
+			}()
+
+			h.ServeHTTP(rec, r)
+			storeResponse(key, rec)
+			completed = true
+		})
+	}
+}
+
+// IdempotencyKey returns the idempotency key or delivery id of the request.
+func IdempotencyKey(r *http.Request) string {
+	for _, header := range deliveryHeaders {
+		if key := r.Header.Get(header); key != "" {
+			return header + ":" + key
+		}
+	}
+
+	return ""
+}
+
+// WriteHeader records the status code.
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write records the body.
+func (r *responseRecorder) Write(buf []byte) (int, error) {
+	r.body.Write(buf)
+	return r.ResponseWriter.Write(buf)
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// claimResponse returns the stored response of the key. If there is none,
+// an empty response is stored and the caller becomes its owner.
+func claimResponse(key string, hash [sha256.Size]byte) (*storedResponse, bool) {
+	responseMutex.Lock()
+	defer responseMutex.Unlock()
+
+	now := time.Now()
+	stored, ok := responses[key]
+	if ok && (!stored.done || now.Before(stored.expires)) {
+		return stored, false
+	}
+
+	if len(responses) >= IdempotencyEntries {
+		expireResponses(now)
+	}
+
+	stored = &storedResponse{hash: hash}
+	responses[key] = stored
+	return stored, true
+}
+
+// storeResponse remembers the recorded response. Responses which might
+// change on a retry are forgotten so the request can be retried.
+func storeResponse(key string, rec *responseRecorder) {
+	responseMutex.Lock()
+	defer responseMutex.Unlock()
+
+	if !isFinalStatus(rec.status) {
+		delete(responses, key)
+		return
+	}
+
+	stored := responses[key]
+	stored.done = true
+	stored.status = rec.status
+	stored.body = rec.body.Bytes()
+	stored.expires = time.Now().Add(IdempotencyTtl)
+	stored.header = make(http.Header)
+	for _, name := range []string{"Content-Type", "Retry-After"} {
+		if value := rec.Header().Get(name); value != "" {
+			stored.header.Set(name, value)
+		}
+	}
+}
+
+// isFinalStatus returns true for successful responses and client errors
+// which a retry of the same request would receive again. Conflicts, closed
+// windows, freezes, rate limits and server errors are transient.
+func isFinalStatus(status int) bool {
+	switch status {
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound,
+		http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+		return true
+	}
+
+	return status >= http.StatusOK && status < http.StatusMultipleChoices
+}
+
+// forgetResponse removes the response of the key.
+func forgetResponse(key string) {
+	responseMutex.Lock()
+	delete(responses, key)
+	responseMutex.Unlock()
+}
+
+// expireResponses removes all expired responses. If the store is still
+// full, the completed response expiring first is removed.
+// The caller must hold the lock.
+func expireResponses(now time.Time) {
+	var first string
+	for key, stored := range responses {
+		if !stored.done {
+			continue
+		}
+
+		if now.After(stored.expires) {
+			delete(responses, key)
+		} else if first == "" || stored.expires.Before(responses[first].expires) {
+			first = key
+		}
+	}
+
+	if len(responses) >= IdempotencyEntries && first != "" {
+		delete(responses, first)
+	}
+}
+
+// requestHash identifies the content of a request.
+// The key parameter is not part of the request.
+func requestHash(r *http.Request, body []byte) [sha256.Size]byte {
+	query := r.URL.Query()
+	query.Del("key")
+
+	h := sha256.New()
+	h.Write([]byte(query.Encode()))
+	h.Write([]byte{0})
+	h.Write([]byte(r.Header.Get("Content-Type")))
+	h.Write([]byte{0})
+	h.Write(body)
+
+	var hash [sha256.Size]byte
+	copy(hash[:], h.Sum(nil))
+	return hash
+}
@@ -0,0 +1,201 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/faryon93/util"
+	"github.com/gorilla/mux"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// ServiceInfo describes a service managed by whalepost.
+type ServiceInfo struct {
+	Id             string              `json:"id"`
+	Name           string              `json:"name"`
+	Image          string              `json:"image"`
+	Digest         string              `json:"digest,omitempty"`
+	Mode           string              `json:"mode"`
+	Replicas       *uint64             `json:"replicas,omitempty"`
+	RunningTasks   int                 `json:"runningTasks"`
+	DesiredTasks   int                 `json:"desiredTasks"`
+	UpdateStatus   *swarm.UpdateStatus `json:"updateStatus,omitempty"`
+	LastDeployment *time.Time          `json:"lastDeployment,omitempty"`
+	Labels         map[string]string   `json:"labels"`
+}
+
+// ServicesResponse is the list of managed services.
+type ServicesResponse struct {
+	Status   string        `json:"status"`
+	Services []ServiceInfo `json:"services"`
+}
+
+// ServiceResponse is a single managed service.
+type ServiceResponse struct {
+	Status  string      `json:"status"`
+	Service ServiceInfo `json:"service"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// ServiceList lists all services which may be managed by whalepost.
+func ServiceList(w http.ResponseWriter, r *http.Request) {
+	log := RequestLogger(r)
+
+	docker, err := NewDockerClient()
+	if err != nil {
+		log.Errorln("failed to create docker client:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusInternalServerError, CodeDockerClient, "failed to create docker client"))
+		return
+	}
+
+	ctx := context.Background()
+	opts := types.ServiceListOptions{Filters: filters.NewArgs(filters.Arg("label", LabelAllow))}
+	services, err := docker.ServiceList(ctx, opts)
+	if err != nil {
+		log.Errorln("failed to list services:", err.Error())
+		WriteError(w, r, NewDockerError(CodeDockerError, "failed to list services", err))
+		return
+	}
+
+	tasks, err := docker.TaskList(ctx, types.TaskListOptions{})
+	if err != nil {
+		log.Errorln("failed to list tasks:", err.Error())
+		WriteError(w, r, NewDockerError(CodeDockerError, "failed to list tasks", err))
+		return
+	}
+
+	token, source := RequestToken(r), RemoteAddr(r)
+	infos := make([]ServiceInfo, 0, len(services))
+	for i := range services {
+		labels := services[i].Spec.Labels
+		if IsLabelEnabled(labels, LabelAllow) && token.AllowsService(&services[i]) && IsSourceAllowed(labels, source) {
+			infos = append(infos, newServiceInfo(&services[i], tasks))
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	util.Jsonify(w, ServicesResponse{Status: "success", Services: infos})
+}
+
+// ServiceGet returns a single service which may be managed by whalepost.
+func ServiceGet(w http.ResponseWriter, r *http.Request) {
+	serviceId := mux.Vars(r)["ServiceId"]
+	log := RequestLogger(r).
+		WithField("service", serviceId)
+
+	docker, err := NewDockerClient()
+	if err != nil {
+		log.Errorln("failed to create docker client:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusInternalServerError, CodeDockerClient, "failed to create docker client"))
+		return
+	}
+
+	ctx := RequestContext(r)
+	service, err := inspectAllowed(ctx, log, docker, serviceId)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	opts := types.TaskListOptions{Filters: filters.NewArgs(filters.Arg("service", service.ID))}
+	tasks, err := docker.TaskList(ctx, opts)
+	if err != nil {
+		log.Errorln("failed to list tasks:", err.Error())
+		WriteError(w, r, NewDockerError(CodeDockerError, "failed to list tasks", err))
+		return
+	}
+
+	util.Jsonify(w, ServiceResponse{Status: "success", Service: newServiceInfo(service, tasks)})
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// newServiceInfo summarizes the service and its tasks.
+func newServiceInfo(service *swarm.Service, tasks []swarm.Task) ServiceInfo {
+	info := ServiceInfo{
+		Id:           service.ID,
+		Name:         service.Spec.Name,
+		UpdateStatus: service.UpdateStatus,
+		Labels:       make(map[string]string),
+	}
+
+	if container := service.Spec.TaskTemplate.ContainerSpec; container != nil {
+		info.Image = container.Image
+		if named, err := reference.ParseNormalizedNamed(container.Image); err == nil {
+			if digested, ok := named.(reference.Digested); ok {
+				info.Digest = digested.Digest().String()
+			}
+		}
+	}
+
+	if replicated := service.Spec.Mode.Replicated; replicated != nil {
+		info.Mode = "replicated"
+		info.Replicas = replicated.Replicas
+	} else {
+		info.Mode = "global"
+	}
+
+	for _, task := range tasks {
+		if task.ServiceID != service.ID || task.DesiredState != swarm.TaskStateRunning {
+			continue
+		}
+
+		info.DesiredTasks++
+		if task.Status.State == swarm.TaskStateRunning {
+			info.RunningTasks++
+		}
+	}
+
+	// prefer the deployments recorded by whalepost
+	if d, ok := LastDeployment(service.Spec.Name); ok {
+		info.LastDeployment = d.Finished
+	} else if service.UpdateStatus != nil && service.UpdateStatus.CompletedAt != nil {
+		info.LastDeployment = service.UpdateStatus.CompletedAt
+	}
+
+	for key, val := range service.Spec.Labels {
+		if strings.HasPrefix(key, LabelPrefix) || key == LabelAllow {
+			info.Labels[key] = val
+		}
+	}
+
+	return info
+}
@@ -0,0 +1,59 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"strings"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	// LabelPrefix is the namespace of all labels evaluated by whalepost.
+	LabelPrefix = "whalepost."
+	// labels set by docker, e.g. the stack a service belongs to
+	LabelDockerPrefix = "com.docker."
+
+	// labels to enable additional spec mutations besides the image
+	LabelAllowEnv     = "whalepost.allow.env"
+	LabelAllowLabels  = "whalepost.allow.labels"
+	LabelAllowSecrets = "whalepost.allow.secrets"
+	LabelAllowConfigs = "whalepost.allow.configs"
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// IsLabelEnabled returns true if the label is set to a truthy value.
+func IsLabelEnabled(labels map[string]string, key string) bool {
+	val := strings.ToLower(strings.TrimSpace(labels[key]))
+	return val == "true" || val == "yes" || val == "on"
+}
+
+// IsProtectedLabel returns true if the label controls the behaviour of
+// whalepost or is managed by docker and therefore must not be changed by a
+// request. The stack label decides the restrictions of tokens.
+func IsProtectedLabel(key string) bool {
+	return strings.HasPrefix(key, LabelPrefix) || strings.HasPrefix(key, LabelDockerPrefix) || key == LabelAllow
+}
@@ -0,0 +1,92 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"sort"
+	"sync"
+)
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	serviceLocks = make(map[string]*serviceLock)
+	serviceMutex sync.Mutex
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+type serviceLock struct {
+	sync.Mutex
+	refs int
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// LockService serializes all modifications of a service.
+// The returned function releases the lock.
+func LockService(serviceId string) func() {
+	serviceMutex.Lock()
+	lock, ok := serviceLocks[serviceId]
+	if !ok {
+		lock = &serviceLock{}
+		serviceLocks[serviceId] = lock
+	}
+	lock.refs++
+	serviceMutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		// forget the lock when nobody is waiting for it anymore
+		serviceMutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(serviceLocks, serviceId)
+		}
+		serviceMutex.Unlock()
+	}
+}
+
+// LockServices locks multiple services in a consistent order
+// to prevent deadlocks. The returned function releases all locks.
+func LockServices(serviceIds ...string) func() {
+	ids := append([]string{}, serviceIds...)
+	sort.Strings(ids)
+
+	unlocks := make([]func(), 0, len(ids))
+	for _, id := range ids {
+		unlocks = append(unlocks, LockService(id))
+	}
+
+	return func() {
+		for i := len(unlocks) - 1; i >= 0; i-- {
+			unlocks[i]()
+		}
+	}
+}
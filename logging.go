@@ -0,0 +1,147 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"regexp"
+
+	"github.com/faryon93/handlers"
+	"github.com/faryon93/util"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	LogFormatText = "text"
+	LogFormatJson = "json"
+
+	RequestIdHeader = "X-Request-ID"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// LogLevelBody is the users request to change the log level.
+type LogLevelBody struct {
+	Level string `json:"level" schema:"level"`
+}
+
+// LogLevelResponse is returned to the user upon success.
+type LogLevelResponse struct {
+	Status string `json:"status"`
+	Level  string `json:"level"`
+}
+
+type requestIdKey struct{}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	// request ids of clients are only accepted if they are harmless
+	validRequestId = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// SetupLogging configures the format and level of the logger.
+func SetupLogging(format, level string, colors bool) error {
+	switch format {
+	case LogFormatText:
+		logrus.SetFormatter(&logrus.TextFormatter{ForceColors: colors})
+	case LogFormatJson:
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return errors.Errorf("unknown log format \"%s\"", format)
+	}
+
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	logrus.SetLevel(lvl)
+	logrus.SetOutput(os.Stdout)
+	return nil
+}
+
+// RequestIdentified assigns an id to every request. The id is taken
+// from the X-Request-ID header or generated and returned to the client.
+func RequestIdentified() handlers.Adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIdHeader)
+			if !validRequestId.MatchString(id) {
+				id = newId()
+			}
+
+			w.Header().Set(RequestIdHeader, id)
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+		})
+	}
+}
+
+// RequestId returns the id of the request.
+func RequestId(r *http.Request) string {
+	id, _ := r.Context().Value(requestIdKey{}).(string)
+	return id
+}
+
+// LogLevelGet returns the current log level.
+func LogLevelGet(w http.ResponseWriter, r *http.Request) {
+	util.Jsonify(w, LogLevelResponse{Status: "success", Level: logrus.GetLevel().String()})
+}
+
+// LogLevelSet changes the log level at runtime.
+func LogLevelSet(w http.ResponseWriter, r *http.Request) {
+	log := RequestLogger(r)
+
+	// parse the request body
+	var body LogLevelBody
+	err := util.ParseBody(r, &body)
+	if err != nil {
+		log.Warnln("failed to parse body:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidBody, "body: "+err.Error()))
+		return
+	}
+
+	level, err := logrus.ParseLevel(body.Level)
+	if err != nil {
+		log.Warnln("rejecting log level:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidRequest, "level: "+err.Error()))
+		return
+	}
+
+	logrus.SetLevel(level)
+	log.Infof("log level changed to %s", level.String())
+	util.Jsonify(w, LogLevelResponse{Status: "success", Level: level.String()})
+}
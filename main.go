@@ -31,6 +31,7 @@ import (
 	"github.com/faryon93/handlers"
 	"github.com/faryon93/util"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
@@ -41,6 +42,8 @@ import (
 const (
 	HttpCloseTimeout = 5 * time.Second
 	HttpListen       = ":8000"
+
+	OverrideHeader = "X-Whalepost-Override"
 )
 
 var (
@@ -49,8 +52,30 @@ var (
 	ApiVersion string
 	LabelAllow string
 	ConfFile   string
+	ConfSet    string
+
+	SettingsFile    string
+	ConvergeTimeout time.Duration
+	CanaryWindow    time.Duration
+	Poll            bool
+	PollInterval    time.Duration
+	PollJitter      time.Duration
+	WindowMode      string
+	AdminToken      string
+	ApproverToken   string
+	ReadToken       string
+	Cluster         string
+	AllowCidr       string
+	TrustedProxy    string
+	DeployRateLimit string
+	IdempotencyTtl  time.Duration
+	AuditFile       string
+	ApprovalTtl     time.Duration
 
-	Config *Conf
+	// the default credential set
+	Config       *Conf
+	AppSettings  *Settings
+	GlobalWindow *Window
 )
 
 // ---------------------------------------------------------------------------------------
@@ -58,43 +83,159 @@ var (
 // ---------------------------------------------------------------------------------------
 
 func main() {
+	// subcommands
+	args := os.Args[1:]
+	check := false
+	if len(args) > 0 {
+		switch args[0] {
+		case "audit":
+			os.Exit(AuditCommand(args[1:]))
+		case "deploy":
+			os.Exit(DeployCommand(args[1:]))
+		case "check":
+			// validates the configuration given by the server flags
+			check, args = true, args[1:]
+		}
+	}
+
 	var colors bool
+	var logFormat, logLevel string
+	var window string
 	var err error
 	flag.BoolVar(&colors, "colors", false, "force color logging")
+	flag.StringVar(&logFormat, "log-format", LogFormatText, "log format: text or json")
+	flag.StringVar(&logLevel, "log-level", "info", "log level: debug, info, warning or error")
 	flag.StringVar(&Token, "token", "", "token for authentication")
 	flag.StringVar(&Endpoint, "endpoint", "unix:///var/run/docker.sock", "docker endpoint")
 	flag.StringVar(&ApiVersion, "api", "1.36", "docker api version")
 	flag.StringVar(&LabelAllow, "label", "whalepost.allow", "label to allow updates")
-	flag.StringVar(&ConfFile, "conf", "/config.json", "path to docker config")
-	flag.Parse()
+	flag.StringVar(&ConfFile, "conf", "/config.json", "comma separated docker configs or directories of them")
+	flag.StringVar(&ConfSet, "conf-default", "config", "credential set used by services without a set of their own")
+	flag.StringVar(&SettingsFile, "settings", "", "path to whalepost settings")
+	flag.DurationVar(&ConvergeTimeout, "converge-timeout", 5*time.Minute, "max time to wait for services to converge")
+	flag.DurationVar(&CanaryWindow, "canary-window", time.Minute, "default time a canary has to stay healthy")
+	flag.BoolVar(&Poll, "poll", false, "poll the registry for new images")
+	flag.DurationVar(&PollInterval, "poll-interval", 5*time.Minute, "default registry poll interval")
+	flag.DurationVar(&PollJitter, "poll-jitter", 30*time.Second, "default max random delay of registry polls")
+	flag.StringVar(&window, "window", "", "global deployment window, e.g. \"CRON_TZ=Europe/Berlin * 8-15 * * mon-thu\"")
+	flag.StringVar(&WindowMode, "window-mode", WindowModeReject, "handling of deployments outside the window: reject or queue")
+	flag.StringVar(&AdminToken, "admin-token", "", "admin token for freezes and emergency overrides")
+	flag.StringVar(&ReadToken, "read-token", "", "read-only token for the service inventory")
+	flag.StringVar(&ApproverToken, "approver-token", "", "token to approve or deny pending deployments")
+	flag.StringVar(&Cluster, "cluster", "", "name of the cluster for token restrictions")
+	flag.StringVar(&AllowCidr, "allow-cidr", "", "comma separated networks allowed to access the api")
+	flag.StringVar(&TrustedProxy, "trusted-proxies", "", "comma separated networks of proxies whose forwarded headers are trusted")
+	flag.StringVar(&DeployRateLimit, "deploy-rate", "", "maximum deployments per service, e.g. \"5/1m\"")
+	flag.DurationVar(&IdempotencyTtl, "idempotency-ttl", 24*time.Hour, "time to remember responses of idempotent requests")
+	flag.StringVar(&AuditFile, "audit", "", "path to the audit log")
+	flag.DurationVar(&ApprovalTtl, "approval-ttl", 24*time.Hour, "time until pending deployments expire")
+	flag.CommandLine.Parse(args)
+	if check {
+		os.Exit(CheckCommand(window, logFormat, logLevel))
+	}
 
 	// make sure all config options are set properly
-	if Token == "" || Endpoint == "" || LabelAllow == "" || ApiVersion == "" {
+	if Endpoint == "" || LabelAllow == "" || ApiVersion == "" ||
+		(WindowMode != WindowModeReject && WindowMode != WindowModeQueue) {
 		flag.Usage()
 		return
 	}
 
 	// setup logger
-	formater := logrus.TextFormatter{ForceColors: colors}
-	logrus.SetFormatter(&formater)
-	logrus.SetOutput(os.Stdout)
+	err = SetupLogging(logFormat, logLevel, colors)
+	if err != nil {
+		logrus.Errorln("invalid logging option:", err.Error())
+		return
+	}
 	logrus.Infoln("starting", GetAppVersion())
 
-	// load the config file
-	Config, err = LoadConf(ConfFile)
-	if err != nil {
+	// load the config files, broken files only disable their own credential set
+	for _, err := range SetupCredentials(ConfFile, ConfSet) {
 		logrus.Warnln("config file not loaded:", err.Error())
 	}
+	if Config == nil && isFlagSet("conf-default") {
+		logrus.Warnf("default credential set \"%s\" not found", ConfSet)
+	}
+
+	// load the whalepost settings
+	AppSettings = &Settings{}
+	if SettingsFile != "" {
+		AppSettings, err = LoadSettings(SettingsFile)
+		if err != nil {
+			logrus.Errorln("failed to load settings:", err.Error())
+			return
+		}
+	}
+
+	err = SetupTokens(AppSettings.Tokens)
+	if err != nil {
+		logrus.Errorln("invalid token:", err.Error())
+		return
+	}
+	err = SetupIssuers(AppSettings.Issuers)
+	if err != nil {
+		logrus.Errorln("invalid issuer:", err.Error())
+		return
+	}
+	if len(tokens) == 0 && len(issuers) == 0 {
+		logrus.Errorln("no tokens configured: use -token or the settings file")
+		return
+	}
+
+	err = SetupNotifiers(AppSettings.Notifiers)
+	if err != nil {
+		logrus.Errorln("invalid notifier:", err.Error())
+		return
+	}
+
+	// open the audit log
+	if AuditFile != "" {
+		Audit, err = OpenAuditLog(AuditFile)
+		if err != nil {
+			logrus.Errorln("failed to open audit log:", err.Error())
+			return
+		}
+		defer Audit.Close()
+	}
+
+	// parse the allowed networks
+	AllowedNets, err = ParseNets(AllowCidr)
+	if err != nil {
+		logrus.Errorln("invalid allowed network:", err.Error())
+		return
+	}
+	TrustedProxies, err = ParseNets(TrustedProxy)
+	if err != nil {
+		logrus.Errorln("invalid trusted proxy:", err.Error())
+		return
+	}
+
+	err = SetupRateLimits(DeployRateLimit)
+	if err != nil {
+		logrus.Errorln("invalid deployment rate:", err.Error())
+		return
+	}
+
+	// parse the global deployment window
+	if window != "" {
+		GlobalWindow, err = ParseWindow(window)
+		if err != nil {
+			logrus.Errorln("invalid deployment window:", err.Error())
+			return
+		}
+	}
 
 	// setup http routes
 	router := mux.NewRouter()
 	router.Path("/robots.txt").HandlerFunc(handlers.NoRobots)
-	r := router.PathPrefix("/api/v1").Subrouter()
-	r.Methods(http.MethodPost).Path("/service/{ServiceId}").
-		Handler(handlers.ChainFunc(ServiceUpdate, handlers.Keyed(Token)))
+	router.Methods(http.MethodGet).Path("/metrics").
+		Handler(handlers.Chain(prometheus.Handler(), Authorized(ScopeRead)))
+	router.Methods(http.MethodGet).Path("/api/openapi.json").HandlerFunc(OpenApiGet)
+	RegisterRoutes(router.PathPrefix("/api/v1").Subrouter(), false)
+	RegisterRoutes(router.PathPrefix("/api/v2").Subrouter(), true)
 
 	// start the webserver
-	srv := &http.Server{Addr: HttpListen, Handler: router}
+	srv := &http.Server{Addr: HttpListen, Handler: handlers.Chain(router, SourceAllowed(), Audited(), RequestIdentified())}
 	go func() {
 		logrus.Println("http server is listening on", HttpListen)
 		err := srv.ListenAndServe()
@@ -104,11 +245,26 @@ func main() {
 		}
 	}()
 	defer func() {
-		ctx, _ := context.WithTimeout(context.Background(), HttpCloseTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), HttpCloseTimeout)
+		defer cancel()
 		srv.Shutdown(ctx)
 		logrus.Infoln("http server shutdown completed")
 	}()
 
+	// start the registry poller
+	if Poll {
+		docker, err := NewDockerClient()
+		if err != nil {
+			logrus.Errorln("failed to create docker client:", err.Error())
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go NewPoller(docker).Run(ctx)
+		logrus.Infoln("registry poller started")
+	}
+
 	// wait for stop signals
 	util.WaitSignal(os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	logrus.Infoln("received SIGINT / SIGTERM going to shutdown")
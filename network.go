@@ -0,0 +1,239 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/faryon93/handlers"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	LabelAllowCidr = "whalepost.allow.cidr"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+type sourceKey struct{}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	AllowedNets    []*net.IPNet
+	TrustedProxies []*net.IPNet
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// ParseNets parses a comma separated list of CIDRs or addresses.
+func ParseNets(list string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0)
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+
+		// single addresses are treated as host networks
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("invalid address \"%s\"", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// PeerAddr returns the address of the directly connected peer.
+func PeerAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// RemoteAddr returns the address of the client. Forwarded headers
+// are only honoured when the request was sent by a trusted proxy.
+func RemoteAddr(r *http.Request) string {
+	peer := PeerAddr(r)
+	if !IsAddrAllowed(TrustedProxies, peer) {
+		return peer
+	}
+
+	// the proxies append the address of their peer
+	if fwd := r.Header["Forwarded"]; len(fwd) > 0 {
+		return forwardedClient(parseForwarded(fwd), peer)
+	}
+	if fwd := r.Header["X-Forwarded-For"]; len(fwd) > 0 {
+		return forwardedClient(strings.Split(strings.Join(fwd, ","), ","), peer)
+	}
+	if real := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(real) != nil {
+		return real
+	}
+
+	return peer
+}
+
+// IsAddrAllowed returns true if the address is part of one of the networks.
+func IsAddrAllowed(nets []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsSourceAllowed checks the address against the allowed networks of a service.
+// Services without allowed networks and unknown addresses are always allowed.
+func IsSourceAllowed(labels map[string]string, addr string) bool {
+	list, ok := labels[LabelAllowCidr]
+	if !ok || addr == "" {
+		return true
+	}
+
+	nets, err := ParseNets(list)
+	if err != nil {
+		logrus.Errorf("invalid label %s: %s", LabelAllowCidr, err.Error())
+		return false
+	}
+
+	return IsAddrAllowed(nets, addr)
+}
+
+// SourceAllowed rejects requests from clients outside of the allowed networks.
+func SourceAllowed() handlers.Adapter {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			addr := RemoteAddr(r)
+			if len(AllowedNets) > 0 && !IsAddrAllowed(AllowedNets, addr) {
+				RequestLogger(r).Warnln("rejecting request: source address not allowed")
+				WriteError(w, r, NewHttpError(http.StatusForbidden, CodeSourceNotAllowed, "source address not allowed"))
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ContextSource returns the client address stored in the context.
+func ContextSource(ctx context.Context) string {
+	addr, _ := ctx.Value(sourceKey{}).(string)
+	return addr
+}
+
+// WithSource returns a context carrying the client address.
+func WithSource(ctx context.Context, addr string) context.Context {
+	if addr == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, sourceKey{}, addr)
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// forwardedClient walks the chain of forwarded addresses from the
+// nearest proxy and returns the first address which is not trusted.
+func forwardedClient(chain []string, peer string) string {
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		addr := stripPort(strings.TrimSpace(chain[i]))
+		if net.ParseIP(addr) == nil {
+			break
+		}
+
+		client = addr
+		if !IsAddrAllowed(TrustedProxies, addr) {
+			break
+		}
+	}
+
+	return client
+}
+
+// parseForwarded returns the for parameters of RFC 7239 Forwarded headers.
+func parseForwarded(headers []string) []string {
+	chain := make([]string, 0)
+	for _, header := range headers {
+		for _, element := range strings.Split(header, ",") {
+			addr := ""
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					addr = strings.Trim(kv[1], "\"")
+				}
+			}
+			chain = append(chain, addr)
+		}
+	}
+
+	return chain
+}
+
+// stripPort removes the port and brackets from an address.
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
@@ -0,0 +1,339 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	EventStarted    = "started"
+	EventSucceeded  = "succeeded"
+	EventFailed     = "failed"
+	EventRolledBack = "rolled-back"
+	EventApproval   = "approval"
+
+	NotifierWebhook = "webhook"
+	NotifierSlack   = "slack"
+	NotifierSmtp    = "smtp"
+
+	NotifyQueueSize = 100
+	NotifyTimeout   = 10 * time.Second
+	NotifyRetries   = 3
+	NotifyBackoff   = 2 * time.Second
+
+	defaultNotifyTemplate = `[whalepost] deployment of {{.Service}} {{.Event}}{{if .Image}}: {{.Image}}{{end}}{{if .Message}} ({{.Message}}){{end}}`
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Event describes a state change of a deployment.
+type Event struct {
+	Event      string    `json:"event"`
+	Service    string    `json:"service"`
+	Image      string    `json:"image,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	Deployment string    `json:"deployment,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// NotifierConf configures a notification target.
+type NotifierConf struct {
+	Type     string            `json:"type"`
+	Events   []string          `json:"events"`
+	Url      string            `json:"url"`
+	Headers  map[string]string `json:"headers"`
+	Template string            `json:"template"`
+	Subject  string            `json:"subject"`
+	Retries  *int              `json:"retries"`
+
+	// smtp settings
+	Host     string   `json:"host"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// Notifier delivers events to a single target.
+type Notifier struct {
+	conf     *NotifierConf
+	template *template.Template
+	subject  *template.Template
+	queue    chan Event
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	notifiers    []*Notifier
+	notifyClient = &http.Client{Timeout: NotifyTimeout}
+
+	// line breaks must not end a mail header
+	headerReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// SetupNotifiers creates and starts the configured notifiers.
+func SetupNotifiers(confs []*NotifierConf) error {
+	for i, conf := range confs {
+		notifier, err := NewNotifier(conf)
+		if err != nil {
+			return errors.Wrapf(err, "notifier %d", i)
+		}
+
+		go notifier.Run()
+		notifiers = append(notifiers, notifier)
+	}
+
+	return nil
+}
+
+// Notify sends the event to all interested notifiers.
+func Notify(event Event) {
+	event.Time = time.Now()
+	for _, notifier := range notifiers {
+		if !notifier.wants(event.Event) {
+			continue
+		}
+
+		// never block the deployment
+		select {
+		case notifier.queue <- event:
+		default:
+			logrus.Warnf("notifier %s: queue full, dropping %s event", notifier.conf.Type, event.Event)
+		}
+	}
+}
+
+// NewNotifier creates a new notifier.
+func NewNotifier(conf *NotifierConf) (*Notifier, error) {
+	switch conf.Type {
+	case NotifierWebhook, NotifierSlack:
+		if conf.Url == "" {
+			return nil, errors.New("url required")
+		}
+	case NotifierSmtp:
+		if conf.Host == "" || conf.From == "" || len(conf.To) == 0 {
+			return nil, errors.New("host, from and to required")
+		}
+	default:
+		return nil, errors.Errorf("unknown type \"%s\"", conf.Type)
+	}
+
+	// webhooks send the plain event by default
+	text := conf.Template
+	if text == "" && conf.Type != NotifierWebhook {
+		text = defaultNotifyTemplate
+	}
+	tmpl, err := template.New("body").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	subject := conf.Subject
+	if subject == "" {
+		subject = defaultNotifyTemplate
+	}
+	subjectTmpl, err := template.New("subject").Parse(subject)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Notifier{
+		conf:     conf,
+		template: tmpl,
+		subject:  subjectTmpl,
+		queue:    make(chan Event, NotifyQueueSize),
+	}, nil
+}
+
+// Run delivers the queued events.
+func (n *Notifier) Run() {
+	retries := NotifyRetries
+	if n.conf.Retries != nil {
+		retries = *n.conf.Retries
+	}
+
+	for event := range n.queue {
+		var err error
+		for attempt := 0; attempt <= retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(NotifyBackoff * time.Duration(attempt))
+			}
+
+			err = n.send(event)
+			if err == nil {
+				break
+			}
+		}
+
+		if err != nil {
+			logrus.Errorf("notifier %s: failed to deliver %s event: %s",
+				n.conf.Type, event.Event, err.Error())
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// wants returns true if the notifier is interested in the event.
+func (n *Notifier) wants(event string) bool {
+	return len(n.conf.Events) == 0 || containsString(n.conf.Events, event)
+}
+
+// send delivers a single event.
+func (n *Notifier) send(event Event) error {
+	switch n.conf.Type {
+	case NotifierWebhook:
+		var body []byte
+		var err error
+		if n.conf.Template == "" {
+			body, err = json.Marshal(event)
+		} else {
+			body, err = render(n.template, event)
+		}
+		if err != nil {
+			return err
+		}
+		return n.post(body)
+
+	case NotifierSlack:
+		text, err := render(n.template, event)
+		if err != nil {
+			return err
+		}
+		body, err := json.Marshal(map[string]string{"text": string(text)})
+		if err != nil {
+			return err
+		}
+		return n.post(body)
+
+	case NotifierSmtp:
+		return n.mail(event)
+	}
+
+	return nil
+}
+
+// post sends the body to the configured url.
+func (n *Notifier) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.conf.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, val := range n.conf.Headers {
+		req.Header.Set(key, val)
+	}
+
+	resp, err := notifyClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return errors.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// mail sends the event as email.
+func (n *Notifier) mail(event Event) error {
+	subject, err := render(n.subject, event)
+	if err != nil {
+		return err
+	}
+	text, err := render(n.template, event)
+	if err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	msg.WriteString("From: " + n.conf.From + "\r\n")
+	msg.WriteString("To: " + strings.Join(n.conf.To, ", ") + "\r\n")
+	msg.WriteString("Subject: " + headerReplacer.Replace(string(subject)) + "\r\n")
+	msg.WriteString("Date: " + event.Time.Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.Write(text)
+
+	var auth smtp.Auth
+	if n.conf.Username != "" {
+		host, _, err := net.SplitHostPort(n.conf.Host)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.conf.Username, n.conf.Password, host)
+	}
+
+	return smtp.SendMail(n.conf.Host, auth, n.conf.From, n.conf.To, msg.Bytes())
+}
+
+// notifyOutcome tells everyone whether the deployment succeeded,
+// failed or has been rolled back.
+func notifyOutcome(event Event, err error) {
+	if e, ok := err.(*HttpError); ok && e.Code == CodeRolledBack {
+		Notify(withEvent(event, EventRolledBack, e.Message))
+	} else if err != nil {
+		Notify(withEvent(event, EventFailed, err.Error()))
+	} else {
+		Notify(withEvent(event, EventSucceeded, ""))
+	}
+}
+
+// withEvent returns a copy of the event with the given type and message.
+func withEvent(event Event, typ string, message string) Event {
+	event.Event = typ
+	event.Message = message
+	return event
+}
+
+// render executes the template with the event.
+func render(tmpl *template.Template, event Event) ([]byte, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, event)
+	return buf.Bytes(), err
+}
@@ -0,0 +1,251 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestNotifierWebhook(t *testing.T) {
+	var body []byte
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		header = r.Header
+	}))
+	defer server.Close()
+
+	n, err := NewNotifier(&NotifierConf{Type: NotifierWebhook, Url: server.URL,
+		Headers: map[string]string{"X-Token": "s3cr3t"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := testEvent(EventSucceeded)
+	err = n.send(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received Event
+	err = json.Unmarshal(body, &received)
+	if err != nil {
+		t.Fatalf("invalid body %q: %s", body, err)
+	}
+	if received.Event != event.Event || received.Service != event.Service || received.Image != event.Image {
+		t.Errorf("received %+v, want %+v", received, event)
+	}
+	if header.Get("X-Token") != "s3cr3t" || header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected headers %v", header)
+	}
+}
+
+func TestNotifierSlack(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+
+	n, err := NewNotifier(&NotifierConf{Type: NotifierSlack, Url: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.send(testEvent(EventRolledBack))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var msg map[string]string
+	json.Unmarshal(body, &msg)
+	want := "[whalepost] deployment of app rolled-back: app:1.5 (update has been rolled back)"
+	if msg["text"] != want {
+		t.Errorf("text = %q, want %q", msg["text"], want)
+	}
+}
+
+func TestNotifierStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	n, err := NewNotifier(&NotifierConf{Type: NotifierWebhook, Url: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.send(testEvent(EventFailed)); err == nil {
+		t.Error("expected error for failed delivery")
+	}
+}
+
+func TestNotifierSmtp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	mails := make(chan string, 1)
+	go serveSmtp(listener, mails)
+
+	n, err := NewNotifier(&NotifierConf{Type: NotifierSmtp, Host: listener.Addr().String(),
+		From: "whalepost@example.com", To: []string{"ops@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// line breaks in the subject must not inject headers
+	event := testEvent(EventFailed)
+	event.Message = "broken\r\nBcc: evil@example.com"
+	err = n.send(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mail string
+	select {
+	case mail = <-mails:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+	}
+
+	headers := strings.SplitN(mail, "\r\n\r\n", 2)[0]
+	for _, line := range strings.Split(headers, "\r\n") {
+		if strings.HasPrefix(line, "Bcc:") {
+			t.Errorf("injected header %q", line)
+		}
+	}
+	if !strings.Contains(headers, "Subject: [whalepost] deployment of app failed: app:1.5 (broken  Bcc: evil@example.com)") {
+		t.Errorf("unexpected headers:\n%s", headers)
+	}
+	if !strings.Contains(headers, "To: ops@example.com") {
+		t.Errorf("missing recipient:\n%s", headers)
+	}
+}
+
+func TestNotifyOutcome(t *testing.T) {
+	n := &Notifier{conf: &NotifierConf{}, queue: make(chan Event, 3)}
+	notifiers = []*Notifier{n}
+	defer func() { notifiers = nil }()
+
+	event := testEvent("")
+	notifyOutcome(event, nil)
+	notifyOutcome(event, errors.New("boom"))
+	notifyOutcome(event, &HttpError{Code: CodeRolledBack, Message: ErrRolledBack.Error(), Err: ErrRolledBack})
+
+	for _, want := range []string{EventSucceeded, EventFailed, EventRolledBack} {
+		if got := (<-n.queue).Event; got != want {
+			t.Errorf("event = %s, want %s", got, want)
+		}
+	}
+}
+
+func TestNotifierWants(t *testing.T) {
+	n := &Notifier{conf: &NotifierConf{Events: []string{EventFailed, EventRolledBack}}}
+	if !n.wants(EventFailed) || n.wants(EventSucceeded) {
+		t.Error("notifier must only want the configured events")
+	}
+
+	n.conf.Events = nil
+	if !n.wants(EventStarted) {
+		t.Error("notifier without events must want all events")
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  helpers
+// ---------------------------------------------------------------------------------------
+
+// testEvent returns an event of the given type.
+func testEvent(typ string) Event {
+	message := ""
+	if typ == EventRolledBack {
+		message = ErrRolledBack.Error()
+	}
+
+	return Event{Event: typ, Service: "app", Image: "app:1.5", Message: message,
+		Deployment: "d3pl0y", Time: time.Now()}
+}
+
+// serveSmtp accepts a single mail and sends its data to mails.
+func serveSmtp(listener net.Listener, mails chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			mails <- data.String()
+			reply("250 queued")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
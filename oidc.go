@@ -0,0 +1,528 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	JwksTimeout        = 10 * time.Second
+	JwksRefresh        = time.Hour
+	JwksMinRefresh     = time.Minute
+	JwtLeeway          = time.Minute
+	JwksMaxSize        = 1 << 20
+	jwtClaimSubject    = "sub"
+	jwtClaimIssuer     = "iss"
+	jwtClaimAudience   = "aud"
+	jwtClaimExpiration = "exp"
+	jwtClaimNotBefore  = "nbf"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// IssuerConf configures a trusted OIDC token issuer.
+type IssuerConf struct {
+	Issuer   string       `json:"issuer"`
+	Audience string       `json:"audience"`
+	Jwks     string       `json:"jwks"`
+	Refresh  string       `json:"refresh"`
+	Rules    []*ClaimRule `json:"rules"`
+
+	refresh time.Duration
+	keys    *keySet
+}
+
+// ClaimRule maps the claims of a token to scopes and restrictions.
+// All claims must match their shell pattern.
+type ClaimRule struct {
+	Name     string            `json:"name"`
+	Claims   map[string]string `json:"claims"`
+	Scopes   []string          `json:"scopes"`
+	Services []string          `json:"services"`
+	Stacks   []string          `json:"stacks"`
+}
+
+// keySet is a cached JSON web key set.
+type keySet struct {
+	source   string
+	keys     map[string]crypto.PublicKey
+	fetched  time.Time
+	fetching bool
+	mutex    sync.Mutex
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	issuers    []*IssuerConf
+	jwksClient = &http.Client{Timeout: JwksTimeout}
+
+	jwtAlgorithms = map[string]crypto.Hash{
+		"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+		"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	}
+	jwtCurves = map[string]string{
+		"ES256": "P-256", "ES384": "P-384", "ES512": "P-521",
+	}
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// SetupIssuers validates the trusted issuers and loads their key sets.
+func SetupIssuers(confs []*IssuerConf) error {
+	for _, conf := range confs {
+		if conf.Issuer == "" || conf.Audience == "" || conf.Jwks == "" {
+			return errors.New("issuer, audience and jwks are required")
+		}
+
+		conf.refresh = JwksRefresh
+		if conf.Refresh != "" {
+			refresh, err := time.ParseDuration(conf.Refresh)
+			if err != nil {
+				return errors.Wrapf(err, "issuer \"%s\": refresh", conf.Issuer)
+			}
+			conf.refresh = refresh
+		}
+
+		for _, rule := range conf.Rules {
+			if rule.Name == "" {
+				return errors.Errorf("issuer \"%s\": rule name is missing", conf.Issuer)
+			}
+			// a rule without claims would grant access to any token of the issuer
+			if len(rule.Claims) == 0 {
+				return errors.Errorf("rule \"%s\": at least one claim is required", rule.Name)
+			}
+			for _, scope := range rule.Scopes {
+				if !containsString(scopes, scope) {
+					return errors.Errorf("rule \"%s\": unknown scope \"%s\"", rule.Name, scope)
+				}
+			}
+		}
+
+		conf.keys = &keySet{source: conf.Jwks}
+		err := conf.keys.load()
+		if err != nil {
+			return errors.Wrapf(err, "issuer \"%s\": jwks", conf.Issuer)
+		}
+	}
+
+	issuers = confs
+	return nil
+}
+
+// IsJwt returns true if the key looks like a JSON web token.
+func IsJwt(key string) bool {
+	return strings.Count(key, ".") == 2
+}
+
+// VerifyJwt validates the JSON web token and maps its claims
+// to a token by the rules of the issuer.
+func VerifyJwt(raw string) (*ApiToken, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header jwtHeader
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, errors.Wrap(err, "header")
+	}
+
+	claims := make(map[string]interface{})
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, errors.Wrap(err, "claims")
+	}
+
+	// the issuer selects the keys used to verify the signature
+	iss, _ := claims[jwtClaimIssuer].(string)
+	conf := findIssuer(iss)
+	if conf == nil {
+		return nil, errors.Errorf("untrusted issuer \"%s\"", iss)
+	}
+
+	hash, ok := jwtAlgorithms[header.Alg]
+	if !ok {
+		return nil, errors.Errorf("unsupported algorithm \"%s\"", header.Alg)
+	}
+
+	key, err := conf.keys.get(header.Kid, conf.refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "signature")
+	}
+
+	err = verifySignature(key, header.Alg, hash, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, err
+	}
+
+	// the signature is valid, check whether the token may be used
+	now := time.Now()
+	exp, ok := claims[jwtClaimExpiration].(float64)
+	if !ok {
+		return nil, errors.New("expiration is missing")
+	}
+	expires := time.Unix(int64(exp), 0)
+	if now.After(expires.Add(JwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims[jwtClaimNotBefore].(float64); ok && now.Add(JwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not yet valid")
+	}
+	if !hasAudience(claims[jwtClaimAudience], conf.Audience) {
+		return nil, errors.Errorf("audience \"%s\" is missing", conf.Audience)
+	}
+
+	// the first matching rule grants access
+	sub, _ := claims[jwtClaimSubject].(string)
+	for _, rule := range conf.Rules {
+		if !rule.Match(claims) {
+			continue
+		}
+
+		return &ApiToken{
+			Name:     rule.Name + ":" + sub,
+			Scopes:   rule.Scopes,
+			Services: rule.Services,
+			Stacks:   rule.Stacks,
+			Expires:  &expires,
+		}, nil
+	}
+
+	return nil, errors.Errorf("no rule matches subject \"%s\"", sub)
+}
+
+// Match returns true if all claims match the patterns of the rule.
+func (c *ClaimRule) Match(claims map[string]interface{}) bool {
+	for name, pattern := range c.Claims {
+		value, ok := claims[name]
+		if !ok || !matchAny([]string{pattern}, claimString(value)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// get returns the key with the given id. Unknown keys cause a
+// refresh of the key set, because the issuer might have rotated its keys.
+// The key set is fetched without holding the lock, concurrent requests
+// keep using the cached keys in the meantime.
+func (k *keySet) get(kid string, refresh time.Duration) (crypto.PublicKey, error) {
+	k.mutex.Lock()
+	age := time.Since(k.fetched)
+	key, ok := k.find(kid)
+	fetch := !k.fetching && (age > refresh || (!ok && age > JwksMinRefresh))
+	if fetch {
+		k.fetching = true
+	}
+	k.mutex.Unlock()
+
+	if fetch {
+		keys, err := loadKeys(k.source)
+
+		k.mutex.Lock()
+		k.fetching = false
+		if err == nil {
+			k.keys, k.fetched = keys, time.Now()
+			key, ok = k.find(kid)
+		}
+		k.mutex.Unlock()
+
+		if err != nil && !ok {
+			return nil, errors.Wrap(err, "jwks")
+		}
+	}
+
+	if !ok {
+		return nil, errors.Errorf("unknown key \"%s\"", kid)
+	}
+
+	return key, nil
+}
+
+// find returns the key with the given id. Tokens without a key
+// id can only be used when the set contains a single key.
+func (k *keySet) find(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(k.keys) == 1 {
+		for _, key := range k.keys {
+			return key, true
+		}
+	}
+
+	key, ok := k.keys[kid]
+	return key, ok
+}
+
+// load fetches the key set initially.
+func (k *keySet) load() error {
+	keys, err := loadKeys(k.source)
+	if err != nil {
+		return err
+	}
+
+	k.keys, k.fetched = keys, time.Now()
+	return nil
+}
+
+// loadKeys reads a JSON web key set from a file or URL.
+func loadKeys(source string) (map[string]crypto.PublicKey, error) {
+	var buf []byte
+	var err error
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		buf, err = fetchKeys(source)
+	} else {
+		buf, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.Unmarshal(buf, &set)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "key \"%s\"", jwk.Kid)
+		}
+		keys[jwk.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+
+	return keys, nil
+}
+
+// fetchKeys downloads a JSON web key set.
+func fetchKeys(url string) ([]byte, error) {
+	resp, err := jwksClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, JwksMaxSize))
+}
+
+// publicKey decodes the RSA or EC public key.
+func (j *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve \"%s\"", j.Crv)
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	default:
+		return nil, errors.Errorf("unsupported key type \"%s\"", j.Kty)
+	}
+}
+
+// verifySignature checks the signature of the signed content.
+func verifySignature(key crypto.PublicKey, alg string, hash crypto.Hash, content string, signature []byte) error {
+	h := hash.New()
+	h.Write([]byte(content))
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return errors.Errorf("algorithm \"%s\" does not match key", alg)
+		}
+		if rsa.VerifyPKCS1v15(pub, hash, digest, signature) != nil {
+			return errors.New("invalid signature")
+		}
+
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if jwtCurves[alg] != pub.Curve.Params().Name || len(signature) != 2*size {
+			return errors.Errorf("algorithm \"%s\" does not match key", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+
+	default:
+		return errors.New("unsupported key")
+	}
+
+	return nil
+}
+
+// findIssuer returns the configuration of the trusted issuer.
+func findIssuer(iss string) *IssuerConf {
+	for _, conf := range issuers {
+		if conf.Issuer == iss {
+			return conf
+		}
+	}
+
+	return nil
+}
+
+// hasAudience checks whether the audience claim contains the audience.
+func hasAudience(claim interface{}, audience string) bool {
+	switch aud := claim.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// claimString formats a claim for pattern matching.
+func claimString(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	return fmt.Sprint(value)
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(segment string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(buf, v)
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer.
+func decodeBigInt(s string) (*big.Int, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+
+	return new(big.Int).SetBytes(buf), nil
+}
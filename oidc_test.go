@@ -0,0 +1,369 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestVerifyJwt(t *testing.T) {
+	rsaKey := testRsaKey(t)
+	p256Key := testEcKey(t, elliptic.P256())
+	p384Key := testEcKey(t, elliptic.P384())
+	testIssuer(t, testJwksFile(t, map[string]crypto.PublicKey{
+		"rsa": &rsaKey.PublicKey, "p256": &p256Key.PublicKey, "p384": &p384Key.PublicKey,
+	}))
+
+	now := time.Now()
+	tests := []struct {
+		name   string
+		alg    string
+		kid    string
+		key    crypto.Signer
+		claims map[string]interface{}
+		valid  bool
+	}{
+		{"rs256", "RS256", "rsa", rsaKey, testClaims(now), true},
+		{"es256", "ES256", "p256", p256Key, testClaims(now), true},
+		{"es384", "ES384", "p384", p384Key, testClaims(now), true},
+		{"es384 with p-256 key", "ES384", "p256", p256Key, testClaims(now), false},
+		{"es256 with p-384 key", "ES256", "p384", p384Key, testClaims(now), false},
+		{"es256 with rsa key", "ES256", "rsa", rsaKey, testClaims(now), false},
+		{"unknown key", "RS256", "other", rsaKey, testClaims(now), false},
+		{"unsupported algorithm", "HS256", "rsa", rsaKey, testClaims(now), false},
+		{"expired", "RS256", "rsa", rsaKey, withClaim(testClaims(now), jwtClaimExpiration, now.Add(-time.Hour).Unix()), false},
+		{"not yet valid", "RS256", "rsa", rsaKey, withClaim(testClaims(now), jwtClaimNotBefore, now.Add(time.Hour).Unix()), false},
+		{"missing expiration", "RS256", "rsa", rsaKey, withClaim(testClaims(now), jwtClaimExpiration, nil), false},
+		{"wrong audience", "RS256", "rsa", rsaKey, withClaim(testClaims(now), jwtClaimAudience, "other"), false},
+		{"audience list", "RS256", "rsa", rsaKey, withClaim(testClaims(now), jwtClaimAudience, []string{"other", "whalepost"}), true},
+		{"missing audience", "RS256", "rsa", rsaKey, withClaim(testClaims(now), jwtClaimAudience, nil), false},
+		{"untrusted issuer", "RS256", "rsa", rsaKey, withClaim(testClaims(now), jwtClaimIssuer, "https://evil.example.com"), false},
+		{"no matching rule", "RS256", "rsa", rsaKey, withClaim(testClaims(now), "repository", "other/app"), false},
+		{"missing rule claim", "RS256", "rsa", rsaKey, withClaim(testClaims(now), "repository", nil), false},
+	}
+
+	for _, test := range tests {
+		token, err := VerifyJwt(testJwt(t, test.alg, test.kid, test.key, test.claims))
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: token was accepted", test.name)
+		} else if test.valid && (token.Name != "app:repo:example/app" || !token.HasAnyScope(ScopeDeploy)) {
+			t.Errorf("%s: unexpected token %+v", test.name, token)
+		}
+	}
+}
+
+func TestVerifyJwtTampered(t *testing.T) {
+	key := testRsaKey(t)
+	testIssuer(t, testJwksFile(t, map[string]crypto.PublicKey{"rsa": &key.PublicKey}))
+
+	raw := testJwt(t, "RS256", "rsa", key, testClaims(time.Now()))
+	parts := strings.Split(raw, ".")
+	claims := withClaim(testClaims(time.Now()), "repository", "example/other")
+	buf, _ := json.Marshal(claims)
+	parts[1] = base64.RawURLEncoding.EncodeToString(buf)
+
+	if _, err := VerifyJwt(strings.Join(parts, ".")); err == nil {
+		t.Error("token with modified claims was accepted")
+	}
+}
+
+func TestSetupIssuers(t *testing.T) {
+	key := testRsaKey(t)
+	jwks := testJwksFile(t, map[string]crypto.PublicKey{"rsa": &key.PublicKey})
+	rule := func() *ClaimRule {
+		return &ClaimRule{Name: "app", Claims: map[string]string{"repository": "example/*"},
+			Scopes: []string{ScopeDeploy}}
+	}
+
+	tests := []struct {
+		name  string
+		conf  *IssuerConf
+		valid bool
+	}{
+		{"valid", &IssuerConf{Issuer: "https://ci", Audience: "whalepost", Jwks: jwks,
+			Rules: []*ClaimRule{rule()}}, true},
+		{"missing audience", &IssuerConf{Issuer: "https://ci", Jwks: jwks,
+			Rules: []*ClaimRule{rule()}}, false},
+		{"missing jwks", &IssuerConf{Issuer: "https://ci", Audience: "whalepost",
+			Rules: []*ClaimRule{rule()}}, false},
+		{"rule without claims", &IssuerConf{Issuer: "https://ci", Audience: "whalepost", Jwks: jwks,
+			Rules: []*ClaimRule{{Name: "any", Scopes: []string{ScopeDeploy}}}}, false},
+		{"unknown scope", &IssuerConf{Issuer: "https://ci", Audience: "whalepost", Jwks: jwks,
+			Rules: []*ClaimRule{{Name: "app", Claims: map[string]string{"sub": "*"}, Scopes: []string{"root"}}}}, false},
+		{"invalid refresh", &IssuerConf{Issuer: "https://ci", Audience: "whalepost", Jwks: jwks, Refresh: "soon",
+			Rules: []*ClaimRule{rule()}}, false},
+	}
+
+	for _, test := range tests {
+		err := SetupIssuers([]*IssuerConf{test.conf})
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: configuration was accepted", test.name)
+		}
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	oldKey := testRsaKey(t)
+	newKey := testEcKey(t, elliptic.P256())
+
+	var mutex sync.Mutex
+	var requests int
+	jwks := testJwks(t, map[string]crypto.PublicKey{"old": &oldKey.PublicKey})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		w.Write(jwks)
+	}))
+	defer server.Close()
+	conf := testIssuer(t, server.URL)
+
+	// the issuer rotates its keys
+	mutex.Lock()
+	jwks = testJwks(t, map[string]crypto.PublicKey{"new": &newKey.PublicKey})
+	mutex.Unlock()
+
+	// unknown keys are not fetched again right after a refresh
+	raw := testJwt(t, "ES256", "new", newKey, testClaims(time.Now()))
+	if _, err := VerifyJwt(raw); err == nil {
+		t.Fatal("token with unknown key was accepted")
+	}
+
+	conf.keys.mutex.Lock()
+	conf.keys.fetched = time.Now().Add(-2 * JwksMinRefresh)
+	conf.keys.mutex.Unlock()
+
+	// concurrent requests must not block each other while the keys are fetched
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := VerifyJwt(raw)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	accepted := 0
+	for err := range errs {
+		if err == nil {
+			accepted++
+		}
+	}
+	if accepted == 0 {
+		t.Error("token with rotated key was rejected")
+	}
+	if _, err := VerifyJwt(raw); err != nil {
+		t.Errorf("unexpected error after refresh: %s", err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if requests != 2 {
+		t.Errorf("key set fetched %d times, want 2", requests)
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  helpers
+// ---------------------------------------------------------------------------------------
+
+// testIssuer configures a single trusted issuer using the key set.
+func testIssuer(t *testing.T, jwks string) *IssuerConf {
+	conf := &IssuerConf{
+		Issuer:   "https://ci.example.com",
+		Audience: "whalepost",
+		Jwks:     jwks,
+		Rules: []*ClaimRule{{
+			Name:   "app",
+			Claims: map[string]string{"repository": "example/app", "ref": "refs/heads/*"},
+			Scopes: []string{ScopeDeploy},
+		}},
+	}
+
+	err := SetupIssuers([]*IssuerConf{conf})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conf
+}
+
+// testClaims returns the claims of a valid token.
+func testClaims(now time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		jwtClaimIssuer:     "https://ci.example.com",
+		jwtClaimSubject:    "repo:example/app",
+		jwtClaimAudience:   "whalepost",
+		jwtClaimExpiration: now.Add(10 * time.Minute).Unix(),
+		jwtClaimNotBefore:  now.Add(-time.Minute).Unix(),
+		"repository":       "example/app",
+		"ref":              "refs/heads/main",
+	}
+}
+
+// withClaim sets or removes (nil) a claim.
+func withClaim(claims map[string]interface{}, name string, value interface{}) map[string]interface{} {
+	if value == nil {
+		delete(claims, name)
+	} else {
+		claims[name] = value
+	}
+
+	return claims
+}
+
+// testJwt signs the claims with the key.
+func testJwt(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Kid: kid})
+	payload, _ := json.Marshal(claims)
+	content := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	hash, ok := jwtAlgorithms[alg]
+	if !ok {
+		hash = crypto.SHA256
+	}
+	h := hash.New()
+	h.Write([]byte(content))
+	digest := h.Sum(nil)
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature = append(padBytes(r, size), padBytes(s, size)...)
+	}
+
+	return content + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// testJwksFile writes the key set to a temporary file.
+func testJwksFile(t *testing.T, keys map[string]crypto.PublicKey) string {
+	dir, err := ioutil.TempDir("", "whalepost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "jwks.json")
+	err = ioutil.WriteFile(path, testJwks(t, keys), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// testJwks encodes the public keys as JSON web key set.
+func testJwks(t *testing.T, keys map[string]crypto.PublicKey) []byte {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+
+	for kid, key := range keys {
+		switch k := key.(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, jsonWebKey{Kty: "RSA", Kid: kid, Use: "sig",
+				N: encodeBigInt(k.N.Bytes()), E: encodeBigInt(big.NewInt(int64(k.E)).Bytes())})
+
+		case *ecdsa.PublicKey:
+			size := (k.Curve.Params().BitSize + 7) / 8
+			set.Keys = append(set.Keys, jsonWebKey{Kty: "EC", Kid: kid, Use: "sig", Crv: k.Curve.Params().Name,
+				X: encodeBigInt(padBytes(k.X, size)), Y: encodeBigInt(padBytes(k.Y, size))})
+		}
+	}
+
+	buf, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf
+}
+
+func testRsaKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func testEcKey(t *testing.T, curve elliptic.Curve) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func encodeBigInt(buf []byte) string {
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// padBytes encodes the integer big-endian with a fixed size.
+func padBytes(i *big.Int, size int) []byte {
+	buf := make([]byte, size)
+	b := i.Bytes()
+	copy(buf[size-len(b):], b)
+	return buf
+}
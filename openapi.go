@@ -0,0 +1,508 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faryon93/handlers"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	OpenApiVersion = "3.0.3"
+	SchemaPrefix   = "#/components/schemas/"
+
+	MediaTypeJson  = "application/json"
+	MediaTypeForm  = "application/x-www-form-urlencoded"
+	MediaTypeEvent = "text/event-stream"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Schema is an OpenAPI schema object.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+// apiDocument is the OpenAPI document of the http api.
+type apiDocument struct {
+	OpenApi    string                              `json:"openapi"`
+	Info       apiInfo                             `json:"info"`
+	Paths      map[string]map[string]*apiOperation `json:"paths"`
+	Components apiComponents                       `json:"components"`
+	Security   []map[string][]string               `json:"security"`
+}
+
+type apiInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type apiComponents struct {
+	Schemas         map[string]*Schema           `json:"schemas"`
+	SecuritySchemes map[string]apiSecurityScheme `json:"securitySchemes"`
+}
+
+type apiSecurityScheme struct {
+	Type   string `json:"type"`
+	Scheme string `json:"scheme,omitempty"`
+	In     string `json:"in,omitempty"`
+	Name   string `json:"name,omitempty"`
+}
+
+type apiOperation struct {
+	OperationId string                  `json:"operationId"`
+	Summary     string                  `json:"summary"`
+	Description string                  `json:"description"`
+	Tags        []string                `json:"tags"`
+	Parameters  []apiParameter          `json:"parameters,omitempty"`
+	RequestBody *apiRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*apiResponse `json:"responses"`
+}
+
+type apiParameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema"`
+}
+
+type apiRequestBody struct {
+	Required bool                    `json:"required"`
+	Content  map[string]apiMediaType `json:"content"`
+}
+
+type apiResponse struct {
+	Description string                  `json:"description"`
+	Content     map[string]apiMediaType `json:"content,omitempty"`
+}
+
+type apiMediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// schemaGenerator derives schemas from go types.
+type schemaGenerator struct {
+	schemas map[string]*Schema
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	pathParamRegex = regexp.MustCompile(`\{(\w+)\}`)
+	timeType       = reflect.TypeOf(time.Time{})
+
+	specOnce     sync.Once
+	specSchemas  map[string]*Schema
+	specDocument []byte
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// OpenApiGet serves the OpenAPI document of the http api.
+func OpenApiGet(w http.ResponseWriter, r *http.Request) {
+	loadSpec()
+	w.Header().Set("Content-Type", MediaTypeJson)
+	w.Write(specDocument)
+}
+
+// Validated rejects requests whose json body does not match the schema of v.
+// Unknown fields, wrong types and trailing data are reported to the user.
+func Validated(v interface{}) handlers.Adapter {
+	loadSpec()
+	schema := &Schema{Ref: SchemaPrefix + reflect.TypeOf(v).Name()}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log := RequestLogger(r)
+
+			mediaType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+			if mediaType != MediaTypeJson {
+				log.Warnf("rejecting request: unsupported content type \"%s\"", mediaType)
+				WriteError(w, r, NewHttpError(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType,
+					"content type must be "+MediaTypeJson))
+				return
+			}
+
+			buf, err := ioutil.ReadAll(r.Body)
+			r.Body.Close()
+			if err != nil {
+				log.Warnln("failed to read body:", err.Error())
+				WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidBody, "body: "+err.Error()))
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(buf))
+
+			err = ValidateJson(schema, buf)
+			if err != nil {
+				log.Warnln("failed to validate body:", err.Error())
+				WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidBody, err.Error()))
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ValidateJson checks that data is a single json value matching schema.
+func ValidateJson(schema *Schema, data []byte) error {
+	loadSpec()
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err := dec.Decode(&v)
+	if err != nil {
+		return errors.New("body: " + err.Error())
+	}
+	if dec.Decode(&struct{}{}) != io.EOF {
+		return errors.New("body: unexpected data after json value")
+	}
+
+	return schema.validate("body", v)
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// loadSpec generates the schemas and the OpenAPI document once.
+func loadSpec() {
+	specOnce.Do(func() {
+		g := schemaGenerator{schemas: make(map[string]*Schema)}
+		doc := apiDocument{
+			OpenApi: OpenApiVersion,
+			Info:    apiInfo{Title: AppName, Version: AppVersion},
+			Paths:   make(map[string]map[string]*apiOperation),
+			Components: apiComponents{
+				Schemas: g.schemas,
+				SecuritySchemes: map[string]apiSecurityScheme{
+					"bearer": {Type: "http", Scheme: "bearer"},
+					"key":    {Type: "apiKey", In: "query", Name: "key"},
+				},
+			},
+			Security: []map[string][]string{{"bearer": {}}, {"key": {}}},
+		}
+
+		g.schema(reflect.TypeOf(ErrorResponse{}))
+		g.schemas["ErrorResponse"].Properties["code"].Enum = ErrorCodes
+
+		for _, version := range []string{"v1", "v2"} {
+			for _, route := range ApiRoutes {
+				path := "/api/" + version + route.Path
+				if doc.Paths[path] == nil {
+					doc.Paths[path] = make(map[string]*apiOperation)
+				}
+				doc.Paths[path][strings.ToLower(route.Method)] = g.operation(version, route)
+			}
+		}
+
+		specSchemas = g.schemas
+		specDocument, _ = json.MarshalIndent(doc, "", "  ")
+	})
+}
+
+// operation describes a route of the given api version.
+func (g schemaGenerator) operation(version string, route Route) *apiOperation {
+	name := runtime.FuncForPC(reflect.ValueOf(route.Handler).Pointer()).Name()
+	name = name[strings.LastIndex(name, ".")+1:]
+
+	op := apiOperation{
+		OperationId: version + "." + name,
+		Summary:     route.Summary,
+		Description: "Requires one of the scopes: " + strings.Join(route.Scopes, ", ") + ".",
+		Tags:        []string{version},
+		Responses:   make(map[string]*apiResponse),
+	}
+
+	for _, match := range pathParamRegex.FindAllStringSubmatch(route.Path, -1) {
+		op.Parameters = append(op.Parameters, apiParameter{
+			Name: match[1], In: "path", Required: true, Schema: &Schema{Type: "string"},
+		})
+	}
+	for _, query := range route.Query {
+		op.Parameters = append(op.Parameters, apiParameter{
+			Name: query, In: "query", Schema: &Schema{Type: "string"},
+		})
+	}
+	if route.Idempotent {
+		op.Parameters = append(op.Parameters, apiParameter{
+			Name: IdempotencyHeader, In: "header", Schema: &Schema{Type: "string"},
+		})
+	}
+
+	if route.Body != nil {
+		schema := g.schema(reflect.TypeOf(route.Body))
+		content := map[string]apiMediaType{MediaTypeJson: {schema}}
+		if version == "v1" {
+			content[MediaTypeForm] = apiMediaType{schema}
+			op.Description += " Unknown fields are ignored."
+		} else {
+			op.Description += " Unknown fields are rejected."
+		}
+		op.RequestBody = &apiRequestBody{Required: true, Content: content}
+	}
+
+	mediaType := MediaTypeJson
+	if route.Stream {
+		mediaType = MediaTypeEvent
+	}
+	op.Responses["200"] = &apiResponse{
+		Description: "success",
+		Content:     map[string]apiMediaType{mediaType: {g.schema(reflect.TypeOf(route.Response))}},
+	}
+	if len(route.Accepted) > 0 {
+		accepted := &Schema{}
+		for _, v := range route.Accepted {
+			accepted.OneOf = append(accepted.OneOf, g.schema(reflect.TypeOf(v)))
+		}
+		op.Responses["202"] = &apiResponse{
+			Description: "accepted",
+			Content:     map[string]apiMediaType{MediaTypeJson: {accepted}},
+		}
+	}
+	op.Responses["default"] = &apiResponse{
+		Description: "error",
+		Content:     map[string]apiMediaType{MediaTypeJson: {&Schema{Ref: SchemaPrefix + "ErrorResponse"}}},
+	}
+
+	return &op
+}
+
+// schema returns the schema of t. Named structs are registered
+// as components and referenced.
+func (g schemaGenerator) schema(t reflect.Type) *Schema {
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := g.schema(t.Elem())
+		if s.Ref != "" {
+			return &Schema{AllOf: []*Schema{s}, Nullable: true}
+		}
+		s.Nullable = true
+		return s
+
+	case reflect.String:
+		return &Schema{Type: "string"}
+
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Schema{Type: "integer"}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		min := 0.0
+		return &Schema{Type: "integer", Minimum: &min}
+
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+
+	case reflect.Slice, reflect.Array:
+		// nil slices and maps are encoded as null
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte", Nullable: true}
+		}
+		return &Schema{Type: "array", Items: g.schema(t.Elem()), Nullable: true}
+
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem()), Nullable: true}
+
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			// reserve the name to stop recursive types
+			g.schemas[t.Name()] = &Schema{}
+			*g.schemas[t.Name()] = *g.object(t)
+		}
+		return &Schema{Ref: SchemaPrefix + t.Name()}
+	}
+
+	return &Schema{}
+}
+
+// object returns the schema of the struct t, rejecting unknown properties.
+func (g schemaGenerator) object(t reflect.Type) *Schema {
+	s := Schema{
+		Type:                 "object",
+		Properties:           make(map[string]*Schema),
+		AdditionalProperties: false,
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+
+		// embedded structs are flattened like encoding/json does
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for prop, schema := range g.object(field.Type).Properties {
+				s.Properties[prop] = schema
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+		s.Properties[name] = g.schema(field.Type)
+	}
+
+	return &s
+}
+
+// validate checks v against the schema and reports the path of the first mismatch.
+func (s *Schema) validate(path string, v interface{}) error {
+	if s.Ref != "" {
+		return specSchemas[strings.TrimPrefix(s.Ref, SchemaPrefix)].validate(path, v)
+	}
+	if v == nil {
+		if s.Nullable || s.Type == "" {
+			return nil
+		}
+		return fmt.Errorf("%s: must not be null", path)
+	}
+	for _, schema := range s.AllOf {
+		err := schema.validate(path, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch s.Type {
+	case "string":
+		if _, ok := v.(string); !ok {
+			return fmt.Errorf("%s: expected string", path)
+		}
+
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: expected boolean", path)
+		}
+
+	case "integer", "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: expected %s", path, s.Type)
+		}
+		if s.Type == "integer" {
+			_, err := strconv.ParseInt(n.String(), 10, 64)
+			_, uerr := strconv.ParseUint(n.String(), 10, 64)
+			if err != nil && uerr != nil {
+				return fmt.Errorf("%s: expected integer", path)
+			}
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return fmt.Errorf("%s: expected %s", path, s.Type)
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return fmt.Errorf("%s: must be at least %v", path, *s.Minimum)
+		}
+
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected array", path)
+		}
+		for i, item := range items {
+			err := s.Items.validate(path+"["+strconv.Itoa(i)+"]", item)
+			if err != nil {
+				return err
+			}
+		}
+
+	case "object":
+		props, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected object", path)
+		}
+
+		// report mismatches in a stable order
+		names := make([]string, 0, len(props))
+		for name := range props {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			schema, ok := s.Properties[name]
+			if !ok {
+				schema, ok = s.AdditionalProperties.(*Schema)
+			}
+			if !ok {
+				return fmt.Errorf("%s.%s: unknown field", path, name)
+			}
+
+			err := schema.validate(path+"."+name, props[name])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
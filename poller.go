@@ -0,0 +1,331 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	LabelPoll         = "whalepost.poll"
+	LabelPollInterval = "whalepost.poll.interval"
+	LabelPollCron     = "whalepost.poll.cron"
+	LabelPollJitter   = "whalepost.poll.jitter"
+	LabelPollAuth     = "whalepost.poll.auth"
+	LabelTrack        = "whalepost.track"
+
+	PollResolution = 15 * time.Second
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Poller checks the registry for new images of labeled services
+// and deploys them when they have changed.
+type Poller struct {
+	docker  *client.Client
+	next    map[string]time.Time
+	digests map[string]string
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// NewPoller creates a new registry poller.
+func NewPoller(docker *client.Client) *Poller {
+	return &Poller{
+		docker:  docker,
+		next:    make(map[string]time.Time),
+		digests: make(map[string]string),
+	}
+}
+
+// Run polls the registry until the context is canceled.
+func (p *Poller) Run(ctx context.Context) {
+	ticker := time.NewTicker(PollResolution)
+	defer ticker.Stop()
+
+	for {
+		p.tick(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// tick checks all services which are due.
+func (p *Poller) tick(ctx context.Context) {
+	opts := types.ServiceListOptions{Filters: filters.NewArgs(filters.Arg("label", LabelPoll))}
+	services, err := p.docker.ServiceList(ctx, opts)
+	if err != nil {
+		logrus.Errorln("poller: failed to list services:", err.Error())
+		return
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	for i := range services {
+		service := &services[i]
+		if !IsLabelEnabled(service.Spec.Labels, LabelAllow) ||
+			!IsLabelEnabled(service.Spec.Labels, LabelPoll) {
+			continue
+		}
+		seen[service.ID] = true
+
+		log := logrus.
+			WithField("poller", true).
+			WithField("service", service.Spec.Name)
+
+		// spread the first check of all services
+		next, ok := p.next[service.ID]
+		if !ok {
+			p.next[service.ID] = now.Add(jitter(service.Spec.Labels))
+			continue
+		}
+		if now.Before(next) {
+			continue
+		}
+
+		err := p.check(ctx, log, service)
+		if err != nil {
+			log.Errorln("poller: check failed:", err.Error())
+		}
+
+		p.next[service.ID], err = nextPoll(service.Spec.Labels, time.Now())
+		if err != nil {
+			log.Errorln("poller: invalid schedule:", err.Error())
+			p.next[service.ID] = time.Now().Add(PollInterval)
+		}
+	}
+
+	// forget services which are no longer polled
+	for id := range p.next {
+		if !seen[id] {
+			delete(p.next, id)
+			delete(p.digests, id)
+		}
+	}
+}
+
+// check resolves the digest of the tracked tag and deploys it when changed.
+func (p *Poller) check(ctx context.Context, log *logrus.Entry, service *swarm.Service) error {
+	if service.Spec.TaskTemplate.ContainerSpec == nil {
+		return errors.New("service has no container spec")
+	}
+
+	named, err := reference.ParseNormalizedNamed(service.Spec.TaskTemplate.ContainerSpec.Image)
+	if err != nil {
+		return err
+	}
+
+	tag := "latest"
+	if tagged, ok := named.(reference.Tagged); ok {
+		tag = tagged.Tag()
+	}
+	currentTag, current := tag, ""
+	if digested, ok := named.(reference.Digested); ok {
+		current = digested.Digest().String()
+	}
+
+	// fetch the registry credentials if requested
+	auth := IsLabelEnabled(service.Spec.Labels, LabelPollAuth) || IsLabelEnabled(service.Spec.Labels, LabelRegistryAuth)
+	var authConfig *types.AuthConfig
+	encodedAuth := ""
+	if auth {
+		if len(CredentialSets) == 0 {
+			return errors.New("credentials cannot be used without config")
+		}
+
+		index, err := getRegistryIndex(named.String())
+		if err != nil {
+			return err
+		}
+		authConfig, err = GetCredentials(service.Spec.Labels, index)
+		if err != nil {
+			return err
+		}
+		encodedAuth, err = EncodeAuth(authConfig)
+		if err != nil {
+			return err
+		}
+	}
+
+	// move to the newest tag matching the tracked version range
+	if track, ok := service.Spec.Labels[LabelTrack]; ok {
+		tag, err = newestTag(named, authConfig, tag, track)
+		if err != nil {
+			return err
+		}
+	}
+
+	target, err := reference.WithTag(reference.TrimNamed(named), tag)
+	if err != nil {
+		return err
+	}
+
+	dist, err := p.docker.DistributionInspect(ctx, target.String(), encodedAuth)
+	if err != nil {
+		return err
+	}
+
+	// images without a digest are compared with the last deployed
+	// digest, the first check only remembers the digest
+	digest := dist.Descriptor.Digest.String()
+	known := true
+	if current == "" {
+		current, known = p.digests[service.ID]
+	}
+
+	if digest == current || (!known && tag == currentTag) {
+		log.Debugf("poller: image \"%s\" is up to date", reference.FamiliarString(target))
+		p.digests[service.ID] = digest
+		return nil
+	}
+
+	// deployments outside of the window are tried again by a later check
+	err = CheckWindow(service.Spec.Labels, time.Now())
+	if _, ok := err.(*WindowError); ok {
+		log.Debugf("poller: deferring image \"%s\": %s", reference.FamiliarString(target), err.Error())
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// a pending approval of the image must not be requested again
+	body := &UpdateBody{Image: reference.FamiliarString(target), Auth: &auth}
+	if d, ok := FindPending(service.Spec.Name, body); ok {
+		log.Debugf("poller: image \"%s\" awaits approval of deployment %s", body.Image, d.Id)
+		p.digests[service.ID] = digest
+		return nil
+	}
+
+	// the digest is only remembered once the deployment is accepted,
+	// rejected and failed deployments are retried by the next check
+	log.Infof("poller: image \"%s\" changed to %s", body.Image, digest)
+	_, err = Deploy(ctx, log, p.docker, service.ID, body)
+	if _, ok := err.(*ApprovalError); err == nil || ok {
+		p.digests[service.ID] = digest
+		return nil
+	}
+
+	return err
+}
+
+// newestTag returns the newest tag of the repository matching the constraint.
+// The current tag is returned when there is no newer one.
+func newestTag(named reference.Named, auth *types.AuthConfig, current, track string) (string, error) {
+	constraint, err := ParseConstraint(track)
+	if err != nil {
+		return "", errors.Wrap(err, LabelTrack)
+	}
+
+	tags, err := ListTags(named, auth)
+	if err != nil {
+		return "", err
+	}
+
+	newest, _ := ParseVersion(current)
+	if newest != nil && !constraint.Match(newest) {
+		newest = nil
+	}
+	for _, tag := range tags {
+		version, err := ParseVersion(tag)
+		if err != nil || !constraint.Match(version) {
+			continue
+		}
+
+		if newest == nil || newest.Less(version) {
+			newest = version
+		}
+	}
+
+	if newest == nil {
+		return "", errors.Errorf("no tag matches \"%s\"", track)
+	}
+
+	return newest.Tag, nil
+}
+
+// nextPoll returns the time of the next check of a service.
+func nextPoll(labels map[string]string, now time.Time) (time.Time, error) {
+	if expr, ok := labels[LabelPollCron]; ok {
+		schedule, err := ParseSchedule(expr)
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		next := schedule.Next(now)
+		if next.IsZero() {
+			return next, errors.New("cron schedule never matches")
+		}
+		return next.Add(jitter(labels)), nil
+	}
+
+	interval := PollInterval
+	if val, ok := labels[LabelPollInterval]; ok {
+		var err error
+		interval, err = time.ParseDuration(val)
+		if err != nil {
+			return time.Time{}, errors.Wrap(err, LabelPollInterval)
+		}
+	}
+
+	return now.Add(interval).Add(jitter(labels)), nil
+}
+
+// jitter returns a random delay to spread the checks of all services.
+func jitter(labels map[string]string) time.Duration {
+	max := PollJitter
+	if val, ok := labels[LabelPollJitter]; ok {
+		if d, err := time.ParseDuration(val); err == nil {
+			max = d
+		}
+	}
+
+	if max <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(max)))
+}
@@ -0,0 +1,368 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	LabelDeployRate = "whalepost.deploy.rate"
+
+	// number of failed authentications before the lockout starts
+	AuthFailureLimit = 5
+	// failures are forgotten after this time without another failure
+	AuthFailureWindow = 15 * time.Minute
+	AuthLockoutBase   = time.Second
+	AuthLockoutMax    = time.Hour
+
+	// maximum number of tracked addresses, tokens and services
+	RateLimitEntries = 10000
+
+	LimitIp      = "ip"
+	LimitToken   = "token"
+	LimitService = "service"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// RateLimitError is returned for throttled requests.
+type RateLimitError struct {
+	*HttpError
+	RetryAfter time.Duration
+}
+
+// Rate allows a number of events per period.
+type Rate struct {
+	Count  int
+	Period time.Duration
+}
+
+// lockout tracks the failed authentications of a client.
+type lockout struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// lockoutTable is a bounded set of lockouts.
+type lockoutTable struct {
+	entries map[string]*lockout
+	mutex   sync.Mutex
+}
+
+// deployLimiter is a bounded sliding window log of deployments per service.
+type deployLimiter struct {
+	deploys map[string][]time.Time
+	mutex   sync.Mutex
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	DeployRate *Rate
+
+	authLockouts = &lockoutTable{entries: make(map[string]*lockout)}
+	deployLimits = &deployLimiter{deploys: make(map[string][]time.Time)}
+
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "whalepost",
+		Name:      "auth_failures_total",
+		Help:      "Number of failed authentications.",
+	}, []string{"limit"})
+	authLockoutsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "whalepost",
+		Name:      "auth_lockouts_total",
+		Help:      "Number of lockouts after failed authentications.",
+	}, []string{"limit"})
+	throttledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "whalepost",
+		Name:      "throttled_requests_total",
+		Help:      "Number of requests rejected by a rate limit.",
+	}, []string{"limit"})
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// SetupRateLimits sets the default deployment rate and registers the metrics.
+func SetupRateLimits(deployRate string) error {
+	rate, err := ParseRate(deployRate)
+	if err != nil {
+		return err
+	}
+	DeployRate = rate
+
+	prometheus.MustRegister(authFailures, authLockoutsTotal, throttledRequests)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "whalepost",
+		Name:      "auth_lockout_entries",
+		Help:      "Number of tracked clients with failed authentications.",
+	}, func() float64 {
+		return float64(authLockouts.Len())
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "whalepost",
+		Name:      "deploy_rate_entries",
+		Help:      "Number of tracked services with recent deployments.",
+	}, func() float64 {
+		return float64(deployLimits.Len())
+	}))
+
+	return nil
+}
+
+// ParseRate parses a rate like "5/1m". An empty string means unlimited.
+func ParseRate(s string) (*Rate, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return nil, errors.Errorf("invalid rate \"%s\": expected count/period", s)
+	}
+
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || count < 1 {
+		return nil, errors.Errorf("invalid rate \"%s\": count must be positive", s)
+	}
+
+	period, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+	if err != nil || period <= 0 {
+		return nil, errors.Errorf("invalid rate \"%s\": period must be a positive duration", s)
+	}
+
+	return &Rate{Count: count, Period: period}, nil
+}
+
+// NewRateLimitError returns a 429 error for a throttled request.
+func NewRateLimitError(limit, code, message string, retry time.Duration) *RateLimitError {
+	throttledRequests.WithLabelValues(limit).Inc()
+	return &RateLimitError{
+		HttpError:  NewHttpError(http.StatusTooManyRequests, code, message),
+		RetryAfter: retry,
+	}
+}
+
+// CheckLockout returns the remaining lockout of a client.
+func CheckLockout(limit, key string) time.Duration {
+	return authLockouts.Check(limit + ":" + key)
+}
+
+// AuthFailed records a failed authentication of a client.
+func AuthFailed(limit, key string) {
+	authFailures.WithLabelValues(limit).Inc()
+	if authLockouts.Fail(limit+":"+key) > 0 {
+		authLockoutsTotal.WithLabelValues(limit).Inc()
+	}
+}
+
+// CheckDeployRate returns the time to wait if the deployment rate
+// of the service has been exceeded.
+func CheckDeployRate(serviceId string, labels map[string]string) (time.Duration, error) {
+	rate, err := deployRate(labels)
+	if err != nil || rate == nil {
+		return 0, err
+	}
+
+	return deployLimits.Wait(serviceId, rate), nil
+}
+
+// RecordDeploy counts a submitted deployment of the service
+// towards its deployment rate.
+func RecordDeploy(serviceId string, labels map[string]string) {
+	rate, err := deployRate(labels)
+	if err != nil || rate == nil {
+		return
+	}
+
+	deployLimits.Record(serviceId, rate)
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// Check returns the remaining lockout of the key.
+func (t *lockoutTable) Check(key string) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	l, ok := t.entries[key]
+	if !ok {
+		return 0
+	}
+
+	return time.Until(l.until)
+}
+
+// Fail records a failure and returns the lockout if the limit has been exceeded.
+// The lockout doubles with every further failure.
+func (t *lockoutTable) Fail(key string) time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	now := time.Now()
+	l, ok := t.entries[key]
+	if !ok || now.Sub(l.last) > AuthFailureWindow {
+		t.makeRoom(now)
+		l = &lockout{}
+		t.entries[key] = l
+	}
+
+	l.failures++
+	l.last = now
+	if l.failures < AuthFailureLimit {
+		return 0
+	}
+
+	exp := math.Min(float64(l.failures-AuthFailureLimit), 32)
+	lock := time.Duration(math.Min(float64(AuthLockoutBase)*math.Pow(2, exp), float64(AuthLockoutMax)))
+	l.until = now.Add(lock)
+
+	return lock
+}
+
+// Len returns the number of tracked keys.
+func (t *lockoutTable) Len() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return len(t.entries)
+}
+
+// makeRoom removes forgotten entries when the table is full.
+// If no entry can be forgotten the oldest one is removed.
+func (t *lockoutTable) makeRoom(now time.Time) {
+	if len(t.entries) < RateLimitEntries {
+		return
+	}
+
+	var oldest string
+	for key, l := range t.entries {
+		if now.Sub(l.last) > AuthFailureWindow && now.After(l.until) {
+			delete(t.entries, key)
+		} else if oldest == "" || l.last.Before(t.entries[oldest].last) {
+			oldest = key
+		}
+	}
+
+	if len(t.entries) >= RateLimitEntries {
+		delete(t.entries, oldest)
+	}
+}
+
+// deployRate returns the deployment rate of a service,
+// which is overridden by its label.
+func deployRate(labels map[string]string) (*Rate, error) {
+	s, ok := labels[LabelDeployRate]
+	if !ok {
+		return DeployRate, nil
+	}
+
+	rate, err := ParseRate(s)
+	if err != nil {
+		return nil, errors.Wrap(err, LabelDeployRate)
+	}
+
+	return rate, nil
+}
+
+// Wait returns the time until the next deployment
+// of the service is allowed by the rate.
+func (l *deployLimiter) Wait(serviceId string, rate *Rate) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	recent := l.recent(serviceId, rate.Period, now)
+	if len(recent) >= rate.Count {
+		return recent[len(recent)-rate.Count].Add(rate.Period).Sub(now)
+	}
+
+	return 0
+}
+
+// Record adds a deployment of the service to the log.
+func (l *deployLimiter) Record(serviceId string, rate *Rate) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if _, ok := l.deploys[serviceId]; !ok {
+		l.makeRoom()
+	}
+	l.deploys[serviceId] = append(l.recent(serviceId, rate.Period, now), now)
+}
+
+// Len returns the number of tracked services.
+func (l *deployLimiter) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return len(l.deploys)
+}
+
+// recent returns the deployments of the service within the period.
+func (l *deployLimiter) recent(serviceId string, period time.Duration, now time.Time) []time.Time {
+	deploys := l.deploys[serviceId]
+	for len(deploys) > 0 && now.Sub(deploys[0]) >= period {
+		deploys = deploys[1:]
+	}
+
+	return deploys
+}
+
+// makeRoom removes the service with the oldest deployment when the table is full.
+func (l *deployLimiter) makeRoom() {
+	if len(l.deploys) < RateLimitEntries {
+		return
+	}
+
+	var oldest string
+	var oldestTime time.Time
+	for id, deploys := range l.deploys {
+		last := deploys[len(deploys)-1]
+		if oldest == "" || last.Before(oldestTime) {
+			oldest, oldestTime = id, last
+		}
+	}
+
+	delete(l.deploys, oldest)
+}
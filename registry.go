@@ -0,0 +1,225 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	RegistryTimeout = 30 * time.Second
+
+	dockerHubDomain   = "docker.io"
+	dockerHubRegistry = "registry-1.docker.io"
+)
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	challengeRegex = regexp.MustCompile(`([a-z]+)="([^"]*)"`)
+	registryClient = &http.Client{Timeout: RegistryTimeout}
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// ListTags returns all tags of the repository using the registry v2 api.
+// The credentials are optional.
+func ListTags(named reference.Named, auth *types.AuthConfig) ([]string, error) {
+	host := reference.Domain(named)
+	if host == dockerHubDomain {
+		host = dockerHubRegistry
+	}
+	path := reference.Path(named)
+
+	var tags []string
+	next := "https://" + host + "/v2/" + path + "/tags/list"
+	token := ""
+	for next != "" {
+		resp, err := registryGet(next, auth, &token)
+		if err != nil {
+			return nil, err
+		}
+
+		var list struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, list.Tags...)
+
+		// follow the pagination link
+		next, err = nextPage(resp, next)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tags, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// registryGet performs a get request and answers an authentication challenge
+// of the registry. The bearer token is cached in token.
+func registryGet(uri string, auth *types.AuthConfig, token *string) (*http.Response, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		req, err := http.NewRequest(http.MethodGet, uri, nil)
+		if err != nil {
+			return nil, err
+		}
+		if *token != "" {
+			req.Header.Set("Authorization", "Bearer "+*token)
+		} else if auth != nil && auth.Username != "" {
+			req.SetBasicAuth(auth.Username, auth.Password)
+		}
+
+		resp, err := registryClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 {
+			return nil, errors.Errorf("registry: unexpected status %s", resp.Status)
+		}
+
+		*token, err = fetchToken(resp.Header.Get("WWW-Authenticate"), auth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, errors.New("registry: authentication failed")
+}
+
+// fetchToken requests a bearer token as described in the challenge.
+func fetchToken(challenge string, auth *types.AuthConfig) (string, error) {
+	params := make(map[string]string)
+	for _, match := range challengeRegex.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+
+	if params["realm"] == "" {
+		return "", errors.New("registry: unsupported authentication challenge")
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil {
+		return "", err
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if auth != nil && auth.Username != "" {
+		req.SetBasicAuth(auth.Username, auth.Password)
+	}
+
+	resp, err := registryClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("registry: token request failed: %s", resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", err
+	}
+
+	if body.Token != "" {
+		return body.Token, nil
+	}
+
+	return body.AccessToken, nil
+}
+
+// nextPage returns the url of the next page given by the link header.
+func nextPage(resp *http.Response, current string) (string, error) {
+	link := resp.Header.Get("Link")
+	if link == "" {
+		return "", nil
+	}
+
+	start, end := 0, 0
+	for i, c := range link {
+		if c == '<' {
+			start = i + 1
+		} else if c == '>' {
+			end = i
+			break
+		}
+	}
+	if end <= start {
+		return "", nil
+	}
+
+	base, err := url.Parse(current)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(link[start:end])
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(ref).String(), nil
+}
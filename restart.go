@@ -0,0 +1,112 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/faryon93/util"
+	"github.com/gorilla/mux"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// RestartBody is the users request to restart a service.
+type RestartBody struct {
+	Wait bool `json:"wait" schema:"wait"`
+}
+
+// RestartResponse is returned to the user upon success.
+type RestartResponse struct {
+	Status     string   `json:"status"`
+	Deployment string   `json:"deployment"`
+	Warnings   []string `json:"warnings"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// ServiceRestart recycles all tasks of a swarm service without changing its spec.
+// Restarts are subject to the same approvals, windows and rate limits as deployments.
+func ServiceRestart(w http.ResponseWriter, r *http.Request) {
+	serviceId := mux.Vars(r)["ServiceId"]
+	log := RequestLogger(r).
+		WithField("service", serviceId)
+
+	log.Infof("triggered restart for service")
+
+	// parse the request body
+	var body RestartBody
+	err := util.ParseBody(r, &body)
+	if err != nil {
+		log.Warnln("failed to parse body:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidBody, "body: "+err.Error()))
+		return
+	}
+
+	docker, err := NewDockerClient()
+	if err != nil {
+		log.Errorln("failed to create docker client:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusInternalServerError, CodeDockerClient, "failed to create docker client"))
+		return
+	}
+
+	// restarts use the registry auth of the current tasks
+	auth := false
+	update := UpdateBody{
+		Auth:     &auth,
+		Restart:  true,
+		Identity: RequestToken(r),
+		Source:   RemoteAddr(r),
+	}
+
+	// an admin may override deployment windows in an emergency
+	update.Override, err = checkOverride(r, log)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	resp, err := Deploy(context.Background(), log, docker, serviceId, &update)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	if body.Wait {
+		err = waitConverged(RequestContext(r), log, docker, serviceId)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+	}
+
+	log.Infoln("restart completed")
+	util.Jsonify(w, RestartResponse{
+		Status:     "success",
+		Deployment: resp.Deployment,
+		Warnings:   resp.Warnings,
+	})
+}
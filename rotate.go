@@ -0,0 +1,362 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/faryon93/util"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// RotateBody is the users request to rotate a secret or config.
+type RotateBody struct {
+	Data   string `json:"data" schema:"data"`
+	Remove bool   `json:"remove" schema:"remove"`
+}
+
+// RotateResponse is returned to the user when at least one service uses the new version.
+// Skipped services were rejected by their labels, windows or limits, failed services
+// could not be updated.
+type RotateResponse struct {
+	Status   string   `json:"status"`
+	Name     string   `json:"name"`
+	Services []string `json:"services"`
+	Pending  []string `json:"pending"`
+	Skipped  []string `json:"skipped"`
+	Failed   []string `json:"failed"`
+	Removing bool     `json:"removing"`
+}
+
+// rotation abstracts the differences between secrets and configs.
+type rotation struct {
+	Kind   string
+	Label  string
+	Find   func(ctx context.Context, docker *client.Client, name string) (string, *swarm.Driver, swarm.Annotations, error)
+	Create func(ctx context.Context, docker *client.Client, annotations swarm.Annotations, templating *swarm.Driver, data []byte) (string, error)
+	Remove func(ctx context.Context, docker *client.Client, id string) error
+	Uses   func(spec *swarm.ContainerSpec, id string) bool
+	Swap   func(old, name string) SpecMutation
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	versionRegex = regexp.MustCompile(`^(.+)_v([0-9]+)$`)
+
+	secretRotation = rotation{
+		Kind:  "secret",
+		Label: LabelAllowSecrets,
+		Find: func(ctx context.Context, docker *client.Client, name string) (string, *swarm.Driver, swarm.Annotations, error) {
+			secret, err := findSecret(ctx, docker, name)
+			if err != nil {
+				return "", nil, swarm.Annotations{}, err
+			}
+			return secret.ID, secret.Spec.Templating, secret.Spec.Annotations, nil
+		},
+		Create: func(ctx context.Context, docker *client.Client, annotations swarm.Annotations, templating *swarm.Driver, data []byte) (string, error) {
+			spec := swarm.SecretSpec{Annotations: annotations, Templating: templating, Data: data}
+			resp, err := docker.SecretCreate(ctx, spec)
+			return resp.ID, err
+		},
+		Remove: func(ctx context.Context, docker *client.Client, id string) error {
+			return docker.SecretRemove(ctx, id)
+		},
+		Uses: func(spec *swarm.ContainerSpec, id string) bool {
+			for _, ref := range spec.Secrets {
+				if ref.SecretID == id {
+					return true
+				}
+			}
+			return false
+		},
+		Swap: func(old, name string) SpecMutation {
+			return SpecMutation{Secrets: map[string]string{old: name}}
+		},
+	}
+
+	configRotation = rotation{
+		Kind:  "config",
+		Label: LabelAllowConfigs,
+		Find: func(ctx context.Context, docker *client.Client, name string) (string, *swarm.Driver, swarm.Annotations, error) {
+			config, err := findConfig(ctx, docker, name)
+			if err != nil {
+				return "", nil, swarm.Annotations{}, err
+			}
+			return config.ID, config.Spec.Templating, config.Spec.Annotations, nil
+		},
+		Create: func(ctx context.Context, docker *client.Client, annotations swarm.Annotations, templating *swarm.Driver, data []byte) (string, error) {
+			spec := swarm.ConfigSpec{Annotations: annotations, Templating: templating, Data: data}
+			resp, err := docker.ConfigCreate(ctx, spec)
+			return resp.ID, err
+		},
+		Remove: func(ctx context.Context, docker *client.Client, id string) error {
+			return docker.ConfigRemove(ctx, id)
+		},
+		Uses: func(spec *swarm.ContainerSpec, id string) bool {
+			for _, ref := range spec.Configs {
+				if ref.ConfigID == id {
+					return true
+				}
+			}
+			return false
+		},
+		Swap: func(old, name string) SpecMutation {
+			return SpecMutation{Configs: map[string]string{old: name}}
+		},
+	}
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// SecretRotate handles the rotation of a swarm secret.
+func SecretRotate(w http.ResponseWriter, r *http.Request) {
+	rotate(w, r, &secretRotation)
+}
+
+// ConfigRotate handles the rotation of a swarm config.
+func ConfigRotate(w http.ResponseWriter, r *http.Request) {
+	rotate(w, r, &configRotation)
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// rotate creates a new version of a secret or config and re-points all
+// allowed services referencing the old version to the new one. Every service
+// is updated by a deployment, which is subject to approvals and rate limits.
+func rotate(w http.ResponseWriter, r *http.Request, rot *rotation) {
+	name := mux.Vars(r)["Name"]
+	log := RequestLogger(r).
+		WithField(rot.Kind, name)
+
+	log.Infof("triggered %s rotation", rot.Kind)
+
+	// parse the request body
+	var body RotateBody
+	err := util.ParseBody(r, &body)
+	if err != nil {
+		log.Warnln("failed to parse body:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidBody, "body: "+err.Error()))
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(body.Data)
+	if err != nil || len(data) == 0 {
+		log.Warnln("rejecting rotation: data is not valid base64")
+		WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidRequest, "data: base64 encoded content required"))
+		return
+	}
+
+	docker, err := NewDockerClient()
+	if err != nil {
+		log.Errorln("failed to create docker client:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusInternalServerError, CodeDockerClient, "failed to create docker client"))
+		return
+	}
+
+	// an admin may override deployment windows in an emergency
+	override, err := checkOverride(r, log)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	// fetch the current version of the object
+	ctx := context.Background()
+	oldId, templating, annotations, err := rot.Find(ctx, docker, name)
+	if err != nil {
+		log.Errorf("failed to find %s: %s", rot.Kind, err.Error())
+		WriteError(w, r, NewHttpError(http.StatusNotFound, CodeObjectNotFound, "no such "+rot.Kind))
+		return
+	}
+
+	services, err := docker.ServiceList(ctx, types.ServiceListOptions{})
+	if err != nil {
+		log.Errorln("failed to list services:", err.Error())
+		WriteError(w, r, NewDockerError(CodeDockerError, "failed to list services", err))
+		return
+	}
+
+	// find all services referencing the old version which may be updated
+	token, source := RequestToken(r), RemoteAddr(r)
+	resp := RotateResponse{Status: "success", Services: []string{}, Pending: []string{},
+		Skipped: []string{}, Failed: []string{}}
+	allowed := make([]swarm.Service, 0, len(services))
+	for _, service := range services {
+		spec := service.Spec.TaskTemplate.ContainerSpec
+		if spec == nil || !rot.Uses(spec, oldId) {
+			continue
+		}
+
+		// services must allow updates and rotations
+		if !IsLabelEnabled(service.Spec.Labels, LabelAllow) ||
+			!IsLabelEnabled(service.Spec.Labels, rot.Label) {
+			log.Warnf("skipping service \"%s\": rotation not allowed", service.Spec.Name)
+			resp.Skipped = append(resp.Skipped, service.Spec.Name)
+			continue
+		}
+
+		if !token.AllowsService(&service) || !IsSourceAllowed(service.Spec.Labels, source) {
+			log.Warnf("skipping service \"%s\": access not allowed", service.Spec.Name)
+			resp.Skipped = append(resp.Skipped, service.Spec.Name)
+			continue
+		}
+
+		allowed = append(allowed, service)
+	}
+
+	// a new version nobody uses would be useless
+	if len(allowed) == 0 {
+		log.Errorf("rejecting rotation: no service may use the new %s", rot.Kind)
+		WriteError(w, r, NewHttpError(http.StatusForbidden, CodeServiceNotAllowed, "no referencing service may be updated"))
+		return
+	}
+
+	// create the next version with the same labels
+	annotations.Name = nextVersion(name)
+	id, err := rot.Create(ctx, docker, annotations, templating, data)
+	if err != nil {
+		log.Errorf("failed to create %s: %s", rot.Kind, err.Error())
+		WriteError(w, r, NewDockerError(CodeDockerError, "failed to create "+rot.Kind, err))
+		return
+	}
+	log.Infof("created %s \"%s\"", rot.Kind, annotations.Name)
+	resp.Name = annotations.Name
+
+	// re-point all services referencing the old version, the deployment
+	// inspects the current spec of the service while holding its lock
+	auth := false
+	var rejected error
+	for _, service := range allowed {
+		update := UpdateBody{
+			Auth:         &auth,
+			SpecMutation: rot.Swap(name, annotations.Name),
+			Rotation:     true,
+			Override:     override,
+			Identity:     token,
+			Source:       source,
+		}
+
+		slog := log.WithField("service", service.Spec.Name)
+		_, err := Deploy(ctx, slog, docker, service.ID, &update)
+		if _, ok := err.(*ApprovalError); ok {
+			resp.Pending = append(resp.Pending, service.Spec.Name)
+			continue
+		} else if status, code := errorStatus(err); err != nil && status < http.StatusInternalServerError && code != CodeVersionConflict {
+			resp.Skipped = append(resp.Skipped, service.Spec.Name)
+			rejected = err
+			continue
+		} else if err != nil {
+			resp.Failed = append(resp.Failed, service.Spec.Name)
+			continue
+		}
+
+		slog.Infof("service now uses %s \"%s\"", rot.Kind, annotations.Name)
+		resp.Services = append(resp.Services, service.Spec.Name)
+	}
+
+	// a new version nobody uses is removed again
+	if len(resp.Services) == 0 && len(resp.Pending) == 0 {
+		err = rot.Remove(ctx, docker, id)
+		if err != nil {
+			log.Errorf("failed to remove unused %s: %s", rot.Kind, err.Error())
+		} else {
+			log.Infof("removed unused %s \"%s\"", rot.Kind, annotations.Name)
+		}
+
+		if len(resp.Failed) > 0 {
+			WriteError(w, r, NewHttpError(http.StatusBadGateway, CodeServiceUpdateFailed, "no referencing service could be updated"))
+		} else {
+			WriteError(w, r, rejected)
+		}
+		return
+	}
+
+	// the old version can only be removed when no one uses it anymore
+	if body.Remove && len(resp.Skipped) == 0 && len(resp.Failed) == 0 && len(resp.Pending) == 0 {
+		resp.Removing = true
+		go removeConverged(log, docker, rot, oldId, resp.Services)
+	} else if body.Remove {
+		log.Warnf("keeping old %s: still referenced by other services", rot.Kind)
+	}
+
+	// some services still use the old version
+	if len(resp.Failed) > 0 {
+		resp.Status = "partial"
+		writeJson(w, http.StatusMultiStatus, resp)
+		return
+	}
+
+	util.Jsonify(w, resp)
+}
+
+// removeConverged waits until all services have converged and
+// removes the old version of the secret or config.
+func removeConverged(log *logrus.Entry, docker *client.Client, rot *rotation, id string, services []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), ConvergeTimeout)
+	defer cancel()
+
+	for _, service := range services {
+		err := WaitConverged(ctx, docker, service)
+		if err != nil {
+			log.Warnf("keeping old %s: service \"%s\" did not converge: %s",
+				rot.Kind, service, err.Error())
+			return
+		}
+	}
+
+	err := rot.Remove(ctx, docker, id)
+	if err != nil {
+		log.Errorf("failed to remove old %s: %s", rot.Kind, err.Error())
+		return
+	}
+
+	log.Infof("removed old %s", rot.Kind)
+}
+
+// nextVersion returns the name of the next version: name_v1 -> name_v2.
+func nextVersion(name string) string {
+	match := versionRegex.FindStringSubmatch(name)
+	if match == nil {
+		return name + "_v2"
+	}
+
+	version, _ := strconv.Atoi(match[2])
+	return match[1] + "_v" + strconv.Itoa(version+1)
+}
@@ -0,0 +1,177 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/docker/docker/api/types"
+	"github.com/faryon93/util"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	LabelScaleMin = "whalepost.scale.min"
+	LabelScaleMax = "whalepost.scale.max"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// ScaleBody is the users request to scale a service.
+type ScaleBody struct {
+	Replicas *uint64 `json:"replicas" schema:"replicas"`
+}
+
+// ScaleResponse is returned to the user upon success.
+type ScaleResponse struct {
+	Status string `json:"status"`
+	Old    uint64 `json:"old"`
+	New    uint64 `json:"new"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// ServiceScale handles the scale request of a replicated swarm service.
+func ServiceScale(w http.ResponseWriter, r *http.Request) {
+	serviceId := mux.Vars(r)["ServiceId"]
+	log := RequestLogger(r).
+		WithField("service", serviceId)
+
+	log.Infof("triggered scaling for service")
+
+	// parse the request body
+	var body ScaleBody
+	err := util.ParseBody(r, &body)
+	if err != nil {
+		log.Warnln("failed to parse body:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidBody, "body: "+err.Error()))
+		return
+	}
+
+	if body.Replicas == nil {
+		log.Warnln("rejecting scaling: replicas missing")
+		WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidBody, "body: replicas required"))
+		return
+	}
+
+	docker, err := NewDockerClient()
+	if err != nil {
+		log.Errorln("failed to create docker client:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusInternalServerError, CodeDockerClient, "failed to create docker client"))
+		return
+	}
+
+	// fetch the current service sepcs
+	ctx := RequestContext(r)
+	service, unlock, err := inspectLocked(ctx, log, docker, serviceId)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+	defer unlock()
+
+	// scaling is only allowed within the deployment window
+	err = checkWindowAllowed(r, log, service.Spec.Labels)
+	if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	// only replicated services have a replica count
+	replicated := service.Spec.Mode.Replicated
+	if replicated == nil || replicated.Replicas == nil {
+		log.Errorln("rejecting scaling: service is not in replicated mode")
+		WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeGlobalService, "global services cannot be scaled"))
+		return
+	}
+
+	// the replica count must be within the configured limits
+	min, max, err := scaleLimits(service.Spec.Labels)
+	if err != nil {
+		log.Errorln("rejecting scaling: invalid limits:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusUnprocessableEntity, CodeInvalidLabel, "invalid scale limits: "+err.Error()))
+		return
+	}
+	if *body.Replicas < min || *body.Replicas > max {
+		log.Errorf("rejecting scaling: %d replicas not within [%d, %d]", *body.Replicas, min, max)
+		WriteError(w, r, NewHttpError(http.StatusForbidden, CodeReplicasOutOfRange,
+			fmt.Sprintf("replicas must be within [%d, %d]", min, max)))
+		return
+	}
+
+	// an update config overridden by the last update is restored
+	err = restoreUpdateConfig(&service.Spec)
+	if err != nil {
+		log.Errorln("failed to restore update config:", err.Error())
+		WriteError(w, r, NewHttpError(http.StatusUnprocessableEntity, CodeInvalidLabel, err.Error()))
+		return
+	}
+
+	// update the service
+	old := *replicated.Replicas
+	replicated.Replicas = body.Replicas
+	_, err = docker.ServiceUpdate(ctx, serviceId, service.Version, service.Spec, types.ServiceUpdateOptions{})
+	if err != nil {
+		log.Errorln("failed to update service:", err.Error())
+		WriteError(w, r, NewDockerError(CodeServiceUpdateFailed, "failed to update service", err))
+		return
+	}
+
+	log.Infof("scaled service from %d to %d replicas", old, *body.Replicas)
+	util.Jsonify(w, ScaleResponse{
+		Status: "success",
+		Old:    old,
+		New:    *body.Replicas,
+	})
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// scaleLimits returns the minimum and maximum replicas of a service.
+func scaleLimits(labels map[string]string) (uint64, uint64, error) {
+	min, err := parseUintLabel(labels, LabelScaleMin, 0)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	max, err := parseUintLabel(labels, LabelScaleMax, ^uint64(0))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if min > max {
+		return 0, 0, errors.Errorf("%s %d exceeds %s %d", LabelScaleMin, min, LabelScaleMax, max)
+	}
+
+	return min, max, nil
+}
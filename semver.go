@@ -0,0 +1,155 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Version is a semantic version parsed from an image tag.
+type Version struct {
+	Major, Minor, Patch int
+	Pre                 string
+	Tag                 string
+}
+
+// Constraint is a range of versions, e.g. "~1.4", "^1.4.2", ">=2" or "1.4.x".
+type Constraint struct {
+	min *Version
+	max *Version
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	versionTagRegex = regexp.MustCompile(`^v?([0-9]+)(?:\.([0-9]+))?(?:\.([0-9]+))?(?:-([0-9A-Za-z.-]+))?$`)
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// ParseVersion parses a tag like "v1.4.2" or "1.4" into a version.
+func ParseVersion(tag string) (*Version, error) {
+	match := versionTagRegex.FindStringSubmatch(tag)
+	if match == nil {
+		return nil, errors.Errorf("\"%s\" is not a semantic version", tag)
+	}
+
+	v := Version{Pre: match[4], Tag: tag}
+	v.Major, _ = strconv.Atoi(match[1])
+	if match[2] != "" {
+		v.Minor, _ = strconv.Atoi(match[2])
+	}
+	if match[3] != "" {
+		v.Patch, _ = strconv.Atoi(match[3])
+	}
+
+	return &v, nil
+}
+
+// Less returns true if v is lower than o.
+func (v *Version) Less(o *Version) bool {
+	if v.Major != o.Major {
+		return v.Major < o.Major
+	}
+	if v.Minor != o.Minor {
+		return v.Minor < o.Minor
+	}
+	if v.Patch != o.Patch {
+		return v.Patch < o.Patch
+	}
+
+	// a pre-release is lower than the release
+	if v.Pre == "" || o.Pre == "" {
+		return v.Pre != "" && o.Pre == ""
+	}
+
+	return v.Pre < o.Pre
+}
+
+// ParseConstraint parses a version constraint.
+func ParseConstraint(expr string) (*Constraint, error) {
+	expr = strings.TrimSpace(expr)
+	if expr == "*" || expr == "" {
+		return &Constraint{}, nil
+	}
+
+	// ">=1.2" has no upper bound
+	if strings.HasPrefix(expr, ">=") {
+		min, err := ParseVersion(strings.TrimSpace(expr[2:]))
+		if err != nil {
+			return nil, err
+		}
+		return &Constraint{min: min}, nil
+	}
+
+	op := ""
+	if strings.HasPrefix(expr, "~") || strings.HasPrefix(expr, "^") {
+		op, expr = expr[:1], expr[1:]
+	}
+	expr = strings.TrimSuffix(strings.TrimSuffix(expr, ".x"), ".*")
+
+	min, err := ParseVersion(expr)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Count(strings.TrimPrefix(expr, "v"), ".") + 1
+
+	// determine the exclusive upper bound
+	max := Version{Major: min.Major + 1}
+	switch {
+	case op == "^" && min.Major == 0:
+		max = Version{Minor: min.Minor + 1}
+	case op == "^":
+	case op == "~" && parts == 1, op == "" && parts == 1:
+	case op == "~", op == "" && parts == 2:
+		max = Version{Major: min.Major, Minor: min.Minor + 1}
+	default:
+		max = Version{Major: min.Major, Minor: min.Minor, Patch: min.Patch + 1}
+	}
+
+	return &Constraint{min: min, max: &max}, nil
+}
+
+// Match returns true if the version is within the constraint.
+// Pre-releases never match.
+func (c *Constraint) Match(v *Version) bool {
+	if v.Pre != "" {
+		return false
+	}
+
+	if c.min != nil && v.Less(c.min) {
+		return false
+	}
+
+	return c.max == nil || v.Less(c.max)
+}
@@ -0,0 +1,131 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"testing"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		tag                 string
+		major, minor, patch int
+		pre                 string
+	}{
+		{"1", 1, 0, 0, ""},
+		{"1.4", 1, 4, 0, ""},
+		{"v1.4.2", 1, 4, 2, ""},
+		{"1.4.2-rc.1", 1, 4, 2, "rc.1"},
+		{"10.20.30", 10, 20, 30, ""},
+	}
+
+	for _, test := range tests {
+		v, err := ParseVersion(test.tag)
+		if err != nil {
+			t.Fatalf("ParseVersion(%q): %s", test.tag, err)
+		}
+		if v.Major != test.major || v.Minor != test.minor || v.Patch != test.patch || v.Pre != test.pre {
+			t.Errorf("ParseVersion(%q) = %d.%d.%d-%s", test.tag, v.Major, v.Minor, v.Patch, v.Pre)
+		}
+		if v.Tag != test.tag {
+			t.Errorf("ParseVersion(%q): tag %q", test.tag, v.Tag)
+		}
+	}
+
+	for _, tag := range []string{"", "latest", "1.4.2.1", "v", "1.x", "1.4-"} {
+		if _, err := ParseVersion(tag); err == nil {
+			t.Errorf("ParseVersion(%q): expected error", tag)
+		}
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"1.4.2", "1.4.3", true},
+		{"1.4.3", "1.4.2", false},
+		{"1.4.9", "1.10.0", true},
+		{"1.9", "2", true},
+		{"1.4.2", "1.4.2", false},
+		{"1.4.2-rc.1", "1.4.2", true},
+		{"1.4.2", "1.4.2-rc.1", false},
+		{"1.4.2-alpha", "1.4.2-beta", true},
+	}
+
+	for _, test := range tests {
+		a, _ := ParseVersion(test.a)
+		b, _ := ParseVersion(test.b)
+		if a.Less(b) != test.less {
+			t.Errorf("%s < %s = %t, want %t", test.a, test.b, !test.less, test.less)
+		}
+	}
+}
+
+func TestConstraintMatch(t *testing.T) {
+	tests := []struct {
+		constraint string
+		matches    []string
+		misses     []string
+	}{
+		{"*", []string{"0.1", "1.4.2", "20"}, []string{"1.4.2-rc.1"}},
+		{">=2", []string{"2", "2.0.1", "30.1"}, []string{"1.9.9", "2.0.0-rc.1"}},
+		{"~1.4", []string{"1.4", "1.4.9"}, []string{"1.3.9", "1.5.0"}},
+		{"~1.4.2", []string{"1.4.2", "1.4.9"}, []string{"1.4.1", "1.5.0"}},
+		{"~1", []string{"1.0", "1.9.9"}, []string{"0.9", "2.0"}},
+		{"^1.4.2", []string{"1.4.2", "1.9.0"}, []string{"1.4.1", "2.0.0"}},
+		{"^0.3.1", []string{"0.3.1", "0.3.9"}, []string{"0.3.0", "0.4.0"}},
+		{"1.4.x", []string{"1.4.0", "1.4.9"}, []string{"1.3.9", "1.5.0"}},
+		{"1.x", []string{"1.0.0", "1.9.9"}, []string{"2.0.0"}},
+		{"1.4.2", []string{"1.4.2"}, []string{"1.4.1", "1.4.3"}},
+	}
+
+	for _, test := range tests {
+		c, err := ParseConstraint(test.constraint)
+		if err != nil {
+			t.Fatalf("ParseConstraint(%q): %s", test.constraint, err)
+		}
+
+		for _, tag := range test.matches {
+			v, _ := ParseVersion(tag)
+			if !c.Match(v) {
+				t.Errorf("%q should match %s", test.constraint, tag)
+			}
+		}
+		for _, tag := range test.misses {
+			v, _ := ParseVersion(tag)
+			if c.Match(v) {
+				t.Errorf("%q should not match %s", test.constraint, tag)
+			}
+		}
+	}
+
+	for _, expr := range []string{"latest", ">=foo", "~x"} {
+		if _, err := ParseConstraint(expr); err == nil {
+			t.Errorf("ParseConstraint(%q): expected error", expr)
+		}
+	}
+}
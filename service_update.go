@@ -24,13 +24,16 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/docker/distribution/reference"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/registry"
 	"github.com/faryon93/util"
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
@@ -41,25 +44,49 @@ import (
 // UpdateBody is the users request to update a service image.
 type UpdateBody struct {
 	Image string `json:"image" schema:"image"`
-	Auth  bool   `json:"auth" schema:"auth"`
+	// defaults to the registry auth label of the service
+	Auth *bool `json:"auth" schema:"auth"`
+
+	SpecMutation
+	UpdateConfig *UpdateConfigOverride `json:"updateConfig" schema:"-"`
+
+	// bypasses deployment windows and freezes
+	Override bool `json:"-" schema:"-"`
+	// the deployment has been approved
+	Approved bool `json:"-" schema:"-"`
+	// the deployment is queued when outside of the window
+	Queueable bool `json:"-" schema:"-"`
+	// replaces all tasks without changing the spec
+	Restart bool `json:"-" schema:"-"`
+	// re-points secrets or configs without changing the image
+	Rotation bool `json:"-" schema:"-"`
+	// the deployment this request belongs to
+	DeploymentId string `json:"-" schema:"-"`
+	// the token and address which requested the deployment
+	Identity *ApiToken `json:"-" schema:"-"`
+	Source   string    `json:"-" schema:"-"`
+
+	// respond immediately and deploy in the background
+	Async bool `json:"async" schema:"async"`
 }
 
 // UpdateResponse is returned to the user upon success.
 type UpdateResponse struct {
-	Status   string   `json:"status"`
-	Image    string   `json:"image"`
-	Warnings []string `json:"warnings"`
+	Status     string   `json:"status"`
+	Deployment string   `json:"deployment"`
+	Image      string   `json:"image"`
+	Warnings   []string `json:"warnings"`
+	Color      string   `json:"color,omitempty"`
 }
 
 // ---------------------------------------------------------------------------------------
-//  imports
+//  public functions
 // ---------------------------------------------------------------------------------------
 
 // ServiceUpdate handels the update request of a swarm service.
 func ServiceUpdate(w http.ResponseWriter, r *http.Request) {
 	serviceId := mux.Vars(r)["ServiceId"]
-	log := logrus.
-		WithField("addr", util.GetRemoteAddr(r)).
+	log := RequestLogger(r).
 		WithField("service", serviceId)
 
 	log.Infof("triggered deployment for service")
@@ -69,42 +96,161 @@ func ServiceUpdate(w http.ResponseWriter, r *http.Request) {
 	err := util.ParseBody(r, &body)
 	if err != nil {
 		log.Warnln("failed to parse body:", err.Error())
-		http.Error(w, "body: "+err.Error(), http.StatusBadRequest)
+		WriteError(w, r, NewHttpError(http.StatusBadRequest, CodeInvalidBody, "body: "+err.Error()))
 		return
 	}
 
-	// TODO: choose api version automatically
-	docker, err := client.NewClientWithOpts(client.WithHost(Endpoint), client.WithVersion(ApiVersion))
+	docker, err := NewDockerClient()
 	if err != nil {
 		log.Errorln("failed to create docker client:", err.Error())
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+		WriteError(w, r, NewHttpError(http.StatusInternalServerError, CodeDockerClient, "failed to create docker client"))
 		return
 	}
 
-	// fetch the current service sepcs
-	ctx := context.Background()
-	opt := types.ServiceInspectOptions{}
-	service, _, err := docker.ServiceInspectWithRaw(ctx, serviceId, opt)
-	if client.IsErrNotFound(err) {
-		log.Errorln("failed to inspect service:", err.Error())
-		http.Error(w, "no such service", http.StatusNotFound)
-		return
-	} else if err != nil {
-		log.Errorln("failed to inspect service:", err.Error())
-		http.Error(w, "internal server error", http.StatusInternalServerError)
+	AuditImage(r, body.Image)
+	body.Identity = RequestToken(r)
+	body.Source = RemoteAddr(r)
+
+	// an admin may override deployment windows in an emergency
+	body.Override, err = checkOverride(r, log)
+	if err != nil {
+		WriteError(w, r, err)
 		return
 	}
 
-	// make sure that service updates are allowed
-	allow := strings.ToLower(service.Spec.Labels[LabelAllow])
-	if allow != "true" && allow != "yes" && allow != "on" {
-		log.Errorln("rejecting update: service is not allowed to be updated")
-		http.Error(w, "service update to allowed", http.StatusForbidden)
+	// the progress of async deployments can be followed by the event stream
+	if body.Async {
+		d := NewDeployment(serviceId, &body, DeploymentRunning)
+		body.DeploymentId = d.Id
+		body.Queueable = WindowMode == WindowModeQueue
+		go func() {
+			_, err := Deploy(context.Background(), log, docker, serviceId, &body)
+			if e, ok := err.(*WindowError); ok && body.Queueable {
+				queueDeploy(log, docker, serviceId, &body, e)
+			}
+		}()
+
+		writeJson(w, http.StatusAccepted, PendingResponse{Status: "accepted", Deployment: d})
 		return
 	}
 
+	deployAndRespond(w, r, log, docker, serviceId, &body)
+}
+
+// Deploy updates the service as requested by body.
+// Errors which should be reported to the user are of type *HttpError.
+func Deploy(ctx context.Context, log *logrus.Entry, docker *client.Client, serviceId string, body *UpdateBody) (result *UpdateResponse, err error) {
+	ctx = WithSource(WithToken(ctx, body.Identity), body.Source)
+
+	// every deployment is recorded
+	if body.DeploymentId == "" {
+		body.DeploymentId = NewDeployment(serviceId, body, DeploymentRunning).Id
+	} else {
+		UpdateDeployment(body.DeploymentId, func(d *Deployment) {
+			d.State = DeploymentRunning
+		})
+	}
+	log = log.WithField("deployment", body.DeploymentId)
+
+	// tell everyone about the outcome of the deployment, unless it
+	// is parked, queued or still rolling out
+	event := Event{Service: serviceId, Image: body.Image, Deployment: body.DeploymentId}
+	rolling := false
+	defer func() {
+		if _, ok := err.(*WindowError); (ok && body.Queueable) || rolling {
+			return
+		}
+
+		finishDeployment(body.DeploymentId, result, err)
+		if _, ok := err.(*ApprovalError); !ok {
+			notifyOutcome(event, err)
+		}
+	}()
+
+	// fetch the current service sepcs
+	publishPhase(body.DeploymentId, serviceId, PhaseInspect)
+	service, err := inspectAllowed(ctx, log, docker, serviceId)
+	if err != nil {
+		return nil, err
+	}
+	UpdateDeployment(body.DeploymentId, func(d *Deployment) {
+		d.Service = service.Spec.Name
+	})
+	event.Service = service.Spec.Name
+
+	requested := service
+
+	// blue/green deployments update the inactive service
+	var pair *BlueGreenPair
+	var unlock func()
+	if IsBlueGreen(service) && !body.keepsImage() {
+		pair, unlock, err = inspectPairLocked(ctx, log, docker, service)
+		if err == nil {
+			service = pair.Inactive
+			log = log.WithField("color", pair.Color())
+			log.Infof("deploying to inactive service \"%s\"", service.Spec.Name)
+		}
+	} else {
+		service, unlock, err = inspectLocked(ctx, log, docker, service.ID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// protected services need an approval first
+	err = requireApproval(log, service, body)
+	if err != nil {
+		return nil, err
+	}
+
+	// deployments are only allowed within the window
+	if body.Override {
+		log.Warnln("emergency override of deployment windows")
+	} else {
+		err = CheckWindow(service.Spec.Labels, time.Now())
+		if err != nil {
+			log.Errorln("rejecting update:", err.Error())
+			return nil, err
+		}
+	}
+
+	// deployments are rate limited per service
+	retry, err := CheckDeployRate(requested.ID, requested.Spec.Labels)
+	if err != nil {
+		log.Errorln("rejecting update:", err.Error())
+		return nil, NewHttpError(http.StatusUnprocessableEntity, CodeInvalidLabel, err.Error())
+	} else if retry > 0 {
+		log.Errorln("rejecting update: deployment rate exceeded")
+		return nil, NewRateLimitError(LimitService, CodeRateLimited, "deployment rate exceeded", retry)
+	}
+
+	// make sure that all requested spec mutations are valid and allowed
+	err = body.SpecMutation.Validate()
+	if err != nil {
+		log.Errorln("rejecting update:", err.Error())
+		return nil, NewHttpError(http.StatusBadRequest, CodeInvalidBody, err.Error())
+	}
+	err = body.SpecMutation.Check(service.Spec.Labels)
+	if err != nil {
+		log.Errorln("rejecting update:", err.Error())
+		return nil, NewHttpError(http.StatusForbidden, CodeMutationNotAllowed, err.Error())
+	}
+
 	// if a new image has been requests -> insert it into the new container spec
-	if body.Image != "" {
+	if body.Restart {
+		// a changed force update counter replaces all tasks
+		service.Spec.TaskTemplate.ForceUpdate++
+		log.Infoln("restarting all tasks of the service")
+	} else if body.Rotation {
+		log.Infoln("re-pointing secrets and configs of the service")
+	} else if body.Image != "" {
+		_, err = reference.ParseNormalizedNamed(body.Image)
+		if err != nil {
+			log.Errorln("rejecting update: invalid image:", err.Error())
+			return nil, NewHttpError(http.StatusUnprocessableEntity, CodeInvalidImage, "image: "+err.Error())
+		}
+
 		service.Spec.TaskTemplate.ContainerSpec.Image = body.Image
 		log.Infof("replacing image \"%s\" with \"%s\"",
 			service.Spec.TaskTemplate.ContainerSpec.Image, body.Image)
@@ -112,61 +258,311 @@ func ServiceUpdate(w http.ResponseWriter, r *http.Request) {
 		log.Infoln("updating the configured service image")
 	}
 
+	// apply env, label, secret and config changes
+	err = body.SpecMutation.Apply(ctx, docker, &service.Spec)
+	if err != nil {
+		log.Errorln("failed to mutate service spec:", err.Error())
+		return nil, NewHttpError(http.StatusBadRequest, CodeMutationFailed, "spec: "+err.Error())
+	}
+
+	// an update config overridden by the last update is restored
+	err = restoreUpdateConfig(&service.Spec)
+	if err != nil {
+		log.Errorln("failed to restore update config:", err.Error())
+		return nil, NewHttpError(http.StatusUnprocessableEntity, CodeInvalidLabel, err.Error())
+	}
+
+	// override the update config for this update only, the original is kept
+	// in the spec to be restored after the rollout or by the next update
+	if body.UpdateConfig != nil {
+		original := service.Spec.UpdateConfig
+		service.Spec.UpdateConfig, err = body.UpdateConfig.Apply(original, service.Spec.Labels)
+		if err != nil {
+			log.Errorln("rejecting update: update config:", err.Error())
+			return nil, NewHttpError(http.StatusForbidden, CodeUpdateConfigNotAllowed, "updateConfig: "+err.Error())
+		}
+		err = saveUpdateConfig(&service.Spec, original)
+		if err != nil {
+			log.Errorln("failed to save update config:", err.Error())
+			return nil, NewHttpError(http.StatusInternalServerError, CodeInternal, "failed to save update config")
+		}
+		log.Infoln("overriding update config for this update")
+	}
+
 	// setup the update options
+	publishPhase(body.DeploymentId, service.Spec.Name, PhaseRegistry)
 	updateOpts := types.ServiceUpdateOptions{
-		QueryRegistry: true,
+		QueryRegistry: !body.keepsImage(),
 	}
 
 	// find credentials for the requested image
-	if body.Auth {
-		if Config == nil {
+	if body.UseAuth(service.Spec.Labels) {
+		if len(CredentialSets) == 0 {
 			log.Errorln("credentials cannot be used without config")
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			return
+			return nil, NewHttpError(http.StatusUnprocessableEntity, CodeRegistryAuthMissing, "no registry credentials configured")
 		}
 
-		credentials, err := getImageCredentials(service.Spec.TaskTemplate.ContainerSpec.Image)
+		credentials, err := getImageCredentials(service.Spec.TaskTemplate.ContainerSpec.Image, service.Spec.Labels)
 		if err != nil {
 			log.Errorln("failed to fetch registry credentials:", err.Error())
-			http.Error(w, "internal server error", http.StatusInternalServerError)
-			return
+			switch errors.Cause(err) {
+			case ErrCredentialsNotFound:
+				return nil, NewHttpError(http.StatusUnprocessableEntity, CodeRegistryAuthMissing, "no credentials for registry")
+			case ErrCredentialSetNotFound:
+				return nil, NewHttpError(http.StatusUnprocessableEntity, CodeInvalidLabel, LabelRegistryCredentials+": "+err.Error())
+			}
+			return nil, NewHttpError(http.StatusUnprocessableEntity, CodeInvalidImage, "image: "+err.Error())
 		}
 		updateOpts.EncodedRegistryAuth = credentials
 		log.Infoln("authentican for registry access is enabled")
 	}
 
+	// tell everyone that the deployment starts
+	event.Service = service.Spec.Name
+	event.Image = service.Spec.TaskTemplate.ContainerSpec.Image
+	Notify(withEvent(event, EventStarted, ""))
+
+	// roll out the new spec to a canary first
+	if IsCanaryEnabled(service) && !body.keepsImage() {
+		publishPhase(body.DeploymentId, service.Spec.Name, PhaseCanary)
+		err = RunCanary(ctx, log, docker, service, &service.Spec, updateOpts)
+		if e, ok := err.(*HttpError); ok {
+			log.Errorln("rejecting update:", e.Message)
+			return nil, e
+		} else if err != nil {
+			log.Errorln("rejecting update: canary failed:", err.Error())
+			return nil, NewHttpError(http.StatusUnprocessableEntity, CodeCanaryFailed, "canary failed: "+err.Error())
+		}
+		log.Infoln("canary succeeded, promoting image")
+	}
+
 	// update the service
-	resp, err := docker.ServiceUpdate(ctx, serviceId, service.Version, service.Spec, updateOpts)
+	resp, err := docker.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, updateOpts)
 	if err != nil {
 		log.Errorln("failed to update service:", err.Error())
-		http.Error(w, "internal server error", http.StatusInternalServerError)
-		return
+		return nil, NewDockerError(CodeServiceUpdateFailed, "failed to update service", err)
+	}
+	RecordDeploy(requested.ID, requested.Spec.Labels)
+
+	// remember the spec with the overridden update config to restore it later
+	var overridden *swarm.ServiceSpec
+	if body.UpdateConfig != nil {
+		updated, _, err := docker.ServiceInspectWithRaw(ctx, service.ID, types.ServiceInspectOptions{})
+		if err != nil {
+			log.Warnln("update config is restored by the next update:", err.Error())
+		} else {
+			overridden = &updated.Spec
+		}
 	}
 
+	// the outcome of the deployment is known once the service has converged
+	publishPhase(body.DeploymentId, service.Spec.Name, PhaseSubmitted)
+	rollout := make(chan error, 1)
+	go func() {
+		rollout <- watchTasks(log, docker, body.DeploymentId, service.Spec.Name, service.ID)
+	}()
+
 	// display the warnings returend by docker
 	for i, warn := range resp.Warnings {
 		clean := strings.TrimSpace(strings.Replace(warn, "\n", " ", -1))
 		resp.Warnings[i] = clean
 		log.Warnln("dockerd:", clean)
+		Publish(Progress{Type: ProgressWarning, Deployment: body.DeploymentId,
+			Service: service.Spec.Name, Message: clean})
+	}
+
+	// route the traffic to the updated service once it is healthy
+	if pair != nil {
+		log.Infoln("waiting for service to converge")
+		err = <-rollout
+		if err != nil {
+			return nil, err
+		}
+		if overridden != nil {
+			restoreAfterRollout(ctx, log, docker, service.ID, overridden)
+		}
+
+		err = pair.Switch(ctx, docker)
+		if err != nil {
+			log.Errorln("failed to switch blue/green services:", err.Error())
+			return nil, NewDockerError(CodeBlueGreenSwitchFailed, "failed to switch blue/green services", err)
+		}
+		log.Infof("service \"%s\" is now live", service.Spec.Name)
 	}
 
 	// tell the user that everything is fine
-	log.Infof("deployment completed with image \"%s\"",
+	log.Infof("deployment submitted with image \"%s\"",
 		service.Spec.TaskTemplate.ContainerSpec.Image)
 
-	util.Jsonify(w, UpdateResponse{
-		Status:   "success",
-		Image:    service.Spec.TaskTemplate.ContainerSpec.Image,
-		Warnings: resp.Warnings,
-	})
+	response := UpdateResponse{
+		Status:     "success",
+		Deployment: body.DeploymentId,
+		Image:      service.Spec.TaskTemplate.ContainerSpec.Image,
+		Warnings:   resp.Warnings,
+	}
+	if pair != nil {
+		response.Color = pair.Color()
+		return &response, nil
+	}
+
+	// the deployment is finished by the rollout in the background
+	rolling = true
+	go func() {
+		err := <-rollout
+		if err == nil && overridden != nil {
+			unlock := LockService(service.ID)
+			restoreAfterRollout(ctx, log, docker, service.ID, overridden)
+			unlock()
+		}
+		if err != nil {
+			log.Errorln("deployment failed:", err.Error())
+			finishDeployment(body.DeploymentId, nil, err)
+		} else {
+			log.Infoln("service converged")
+			finishDeployment(body.DeploymentId, &response, nil)
+		}
+		notifyOutcome(event, err)
+	}()
+
+	return &response, nil
+}
+
+// UseAuth returns true if the registry credentials are sent to the swarm agents.
+// Requests without a decision use the default of the service.
+func (b *UpdateBody) UseAuth(labels map[string]string) bool {
+	if b.Auth != nil {
+		return *b.Auth
+	}
+
+	return IsLabelEnabled(labels, LabelRegistryAuth)
 }
 
 // ---------------------------------------------------------------------------------------
 //  private functions
 // ---------------------------------------------------------------------------------------
 
-// getImageCredentials returns the encoded credentials for the given image.
-func getImageCredentials(image string) (string, error) {
+// keepsImage returns true if the request changes the service itself without
+// deploying an image: the running image is kept and neither blue/green nor
+// canary deployments are used.
+func (b *UpdateBody) keepsImage() bool {
+	return b.Restart || b.Rotation
+}
+
+// deployAndRespond runs the deployment and writes the outcome to the client.
+func deployAndRespond(w http.ResponseWriter, r *http.Request, log *logrus.Entry, docker *client.Client, serviceId string, body *UpdateBody) {
+	body.Queueable = WindowMode == WindowModeQueue
+	resp, err := Deploy(context.Background(), log, docker, serviceId, body)
+	if e, ok := err.(*WindowError); ok && body.Queueable {
+		err = queueDeploy(log, docker, serviceId, body, e)
+		if err != nil {
+			WriteError(w, r, err)
+			return
+		}
+
+		writeJson(w, http.StatusAccepted, QueuedResponse{
+			Status:     "queued",
+			Deployment: body.DeploymentId,
+			Opens:      e.Opens,
+		})
+		return
+	} else if err != nil {
+		WriteError(w, r, err)
+		return
+	}
+
+	util.Jsonify(w, resp)
+}
+
+// checkOverride returns true if the request carries a valid admin credential
+// which overrides deployment windows and freezes.
+func checkOverride(r *http.Request, log *logrus.Entry) (bool, error) {
+	override := r.Header.Get(OverrideHeader)
+	if override == "" {
+		return false, nil
+	}
+
+	admin := FindToken(override)
+	if admin == nil || admin.IsExpired() || !admin.HasScope(ScopeAdmin) {
+		AuthFailed(LimitIp, RemoteAddr(r))
+		log.Errorln("rejecting request: invalid override credential")
+		return false, NewHttpError(http.StatusForbidden, CodeForbidden, "invalid override credential")
+	}
+
+	log.Warnf("deployment windows overridden by \"%s\"", admin.Name)
+	return true, nil
+}
+
+// inspectAllowed fetches the service and makes sure that it is allowed to
+// be modified by whalepost.
+func inspectAllowed(ctx context.Context, log *logrus.Entry, docker *client.Client, serviceId string) (*swarm.Service, error) {
+	opt := types.ServiceInspectOptions{}
+	service, _, err := docker.ServiceInspectWithRaw(ctx, serviceId, opt)
+	if client.IsErrNotFound(err) {
+		log.Errorln("failed to inspect service:", err.Error())
+		return nil, NewHttpError(http.StatusNotFound, CodeServiceNotFound, "no such service")
+	} else if err != nil {
+		log.Errorln("failed to inspect service:", err.Error())
+		return nil, NewDockerError(CodeServiceInspectFailed, "failed to inspect service", err)
+	}
+
+	// make sure that service updates are allowed
+	if !IsLabelEnabled(service.Spec.Labels, LabelAllow) {
+		log.Errorln("rejecting update: service is not allowed to be updated")
+		return nil, NewHttpError(http.StatusForbidden, CodeServiceNotAllowed, "service updates not allowed")
+	}
+
+	// the token might be restricted to some services
+	if token := ContextToken(ctx); token != nil && !token.AllowsService(&service) {
+		log.Errorf("rejecting update: token \"%s\" is not allowed for service", token.Name)
+		return nil, NewHttpError(http.StatusForbidden, CodeTokenNotAllowed, "token not allowed for service")
+	}
+
+	// the service might only be deployed from some networks
+	if !IsSourceAllowed(service.Spec.Labels, ContextSource(ctx)) {
+		log.Errorf("rejecting update: source address %s not allowed for service", ContextSource(ctx))
+		return nil, NewHttpError(http.StatusForbidden, CodeSourceNotAllowed, "source address not allowed")
+	}
+
+	return &service, nil
+}
+
+// inspectLocked works like inspectAllowed but additionally serializes
+// all modifications of the service. The returned function releases the lock.
+func inspectLocked(ctx context.Context, log *logrus.Entry, docker *client.Client, serviceId string) (*swarm.Service, func(), error) {
+	service, err := inspectAllowed(ctx, log, docker, serviceId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the service might have changed while waiting for the lock
+	unlock := LockService(service.ID)
+	service, err = inspectAllowed(ctx, log, docker, service.ID)
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+
+	return service, unlock, nil
+}
+
+// getImageCredentials returns the encoded credentials for the given image
+// of a service with the given labels.
+func getImageCredentials(image string, labels map[string]string) (string, error) {
+	index, err := getRegistryIndex(image)
+	if err != nil {
+		return "", err
+	}
+
+	auth, err := GetCredentials(labels, index)
+	if err != nil {
+		return "", err
+	}
+
+	return EncodeAuth(auth)
+}
+
+// getRegistryIndex returns the index of the registry hosting the image.
+func getRegistryIndex(image string) (string, error) {
 	registryRef, err := reference.ParseNormalizedNamed(image)
 	if err != nil {
 		return "", err
@@ -183,5 +579,5 @@ func getImageCredentials(image string) (string, error) {
 		reg = registry.IndexServer
 	}
 
-	return Config.GetAuth(reg)
+	return reg, nil
 }
@@ -0,0 +1,276 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// SpecMutation describes the changes to a service spec besides the image.
+type SpecMutation struct {
+	Env                   map[string]string `json:"env" schema:"-"`
+	EnvRemove             []string          `json:"envRemove" schema:"envRemove"`
+	Labels                map[string]string `json:"labels" schema:"-"`
+	LabelsRemove          []string          `json:"labelsRemove" schema:"labelsRemove"`
+	ContainerLabels       map[string]string `json:"containerLabels" schema:"-"`
+	ContainerLabelsRemove []string          `json:"containerLabelsRemove" schema:"containerLabelsRemove"`
+	Secrets               map[string]string `json:"secrets" schema:"-"`
+	Configs               map[string]string `json:"configs" schema:"-"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// Validate makes sure that the requested mutation is well-formed.
+func (m *SpecMutation) Validate() error {
+	for key := range m.Env {
+		if !isValidEnvKey(key) {
+			return errors.Errorf("invalid env key \"%s\"", key)
+		}
+	}
+	for _, key := range m.EnvRemove {
+		if !isValidEnvKey(key) {
+			return errors.Errorf("invalid env key \"%s\"", key)
+		}
+	}
+
+	return nil
+}
+
+// Check makes sure that the service allows every requested mutation.
+func (m *SpecMutation) Check(labels map[string]string) error {
+	if (len(m.Env) > 0 || len(m.EnvRemove) > 0) && !IsLabelEnabled(labels, LabelAllowEnv) {
+		return errors.New("env mutation not allowed")
+	}
+
+	if m.hasLabels() {
+		if !IsLabelEnabled(labels, LabelAllowLabels) {
+			return errors.New("label mutation not allowed")
+		}
+
+		for _, key := range m.labelKeys() {
+			if IsProtectedLabel(key) {
+				return errors.Errorf("label \"%s\" is protected", key)
+			}
+		}
+	}
+
+	if len(m.Secrets) > 0 && !IsLabelEnabled(labels, LabelAllowSecrets) {
+		return errors.New("secret mutation not allowed")
+	}
+
+	if len(m.Configs) > 0 && !IsLabelEnabled(labels, LabelAllowConfigs) {
+		return errors.New("config mutation not allowed")
+	}
+
+	return nil
+}
+
+// Apply applies the mutation to the given service spec.
+func (m *SpecMutation) Apply(ctx context.Context, docker *client.Client, spec *swarm.ServiceSpec) error {
+	container := spec.TaskTemplate.ContainerSpec
+	if container == nil {
+		return errors.New("service has no container spec")
+	}
+
+	// environment variables
+	for key, val := range m.Env {
+		container.Env = setEnv(container.Env, key, val)
+	}
+	for _, key := range m.EnvRemove {
+		container.Env = removeEnv(container.Env, key)
+	}
+
+	// service and container labels
+	spec.Labels = mutateLabels(spec.Labels, m.Labels, m.LabelsRemove)
+	container.Labels = mutateLabels(container.Labels, m.ContainerLabels, m.ContainerLabelsRemove)
+
+	// swap the secret references to the new versions
+	for old, name := range m.Secrets {
+		ref := findSecretRef(container.Secrets, old)
+		if ref == nil {
+			return errors.Errorf("secret \"%s\" is not referenced by service", old)
+		}
+
+		secret, err := findSecret(ctx, docker, name)
+		if err != nil {
+			return err
+		}
+		ref.SecretID = secret.ID
+		ref.SecretName = name
+	}
+
+	// swap the config references to the new versions
+	for old, name := range m.Configs {
+		ref := findConfigRef(container.Configs, old)
+		if ref == nil {
+			return errors.Errorf("config \"%s\" is not referenced by service", old)
+		}
+
+		config, err := findConfig(ctx, docker, name)
+		if err != nil {
+			return err
+		}
+		ref.ConfigID = config.ID
+		ref.ConfigName = name
+	}
+
+	return nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// hasLabels returns true if service or container labels should be changed.
+func (m *SpecMutation) hasLabels() bool {
+	return len(m.Labels) > 0 || len(m.LabelsRemove) > 0 ||
+		len(m.ContainerLabels) > 0 || len(m.ContainerLabelsRemove) > 0
+}
+
+// labelKeys returns all label keys touched by the mutation.
+func (m *SpecMutation) labelKeys() []string {
+	keys := append([]string{}, m.LabelsRemove...)
+	keys = append(keys, m.ContainerLabelsRemove...)
+	for key := range m.Labels {
+		keys = append(keys, key)
+	}
+	for key := range m.ContainerLabels {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// isValidEnvKey returns true if key can be used as environment variable name.
+func isValidEnvKey(key string) bool {
+	return key != "" && !strings.Contains(key, "=")
+}
+
+// setEnv adds or replaces the environment variable key.
+func setEnv(env []string, key, val string) []string {
+	for i, e := range env {
+		if strings.SplitN(e, "=", 2)[0] == key {
+			env[i] = key + "=" + val
+			return env
+		}
+	}
+
+	return append(env, key+"="+val)
+}
+
+// removeEnv removes the environment variable key.
+func removeEnv(env []string, key string) []string {
+	out := env[:0]
+	for _, e := range env {
+		if strings.SplitN(e, "=", 2)[0] != key {
+			out = append(out, e)
+		}
+	}
+
+	return out
+}
+
+// mutateLabels sets and removes the given labels.
+func mutateLabels(labels map[string]string, set map[string]string, remove []string) map[string]string {
+	if labels == nil && len(set) > 0 {
+		labels = make(map[string]string)
+	}
+
+	for key, val := range set {
+		labels[key] = val
+	}
+	for _, key := range remove {
+		delete(labels, key)
+	}
+
+	return labels
+}
+
+// findSecretRef returns the reference to the secret with the given name.
+func findSecretRef(refs []*swarm.SecretReference, name string) *swarm.SecretReference {
+	for _, ref := range refs {
+		if ref.SecretName == name {
+			return ref
+		}
+	}
+
+	return nil
+}
+
+// findConfigRef returns the reference to the config with the given name.
+func findConfigRef(refs []*swarm.ConfigReference, name string) *swarm.ConfigReference {
+	for _, ref := range refs {
+		if ref.ConfigName == name {
+			return ref
+		}
+	}
+
+	return nil
+}
+
+// findSecret returns the secret with the given name.
+func findSecret(ctx context.Context, docker *client.Client, name string) (*swarm.Secret, error) {
+	opts := types.SecretListOptions{Filters: filters.NewArgs(filters.Arg("name", name))}
+	secrets, err := docker.SecretList(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// the name filter matches prefixes -> find the exact match
+	for i := range secrets {
+		if secrets[i].Spec.Name == name {
+			return &secrets[i], nil
+		}
+	}
+
+	return nil, errors.Errorf("secret \"%s\" not found", name)
+}
+
+// findConfig returns the config with the given name.
+func findConfig(ctx context.Context, docker *client.Client, name string) (*swarm.Config, error) {
+	opts := types.ConfigListOptions{Filters: filters.NewArgs(filters.Arg("name", name))}
+	configs, err := docker.ConfigList(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// the name filter matches prefixes -> find the exact match
+	for i := range configs {
+		if configs[i].Spec.Name == name {
+			return &configs[i], nil
+		}
+	}
+
+	return nil, errors.Errorf("config \"%s\" not found", name)
+}
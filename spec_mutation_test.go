@@ -0,0 +1,157 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types/swarm"
+)
+
+// ---------------------------------------------------------------------------------------
+//  tests
+// ---------------------------------------------------------------------------------------
+
+func TestSpecMutationValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		mutation SpecMutation
+		valid    bool
+	}{
+		{"empty", SpecMutation{}, true},
+		{"env", SpecMutation{Env: map[string]string{"LOG_LEVEL": "info"}, EnvRemove: []string{"DEBUG"}}, true},
+		{"empty env value", SpecMutation{Env: map[string]string{"LOG_LEVEL": ""}}, true},
+		{"empty env key", SpecMutation{Env: map[string]string{"": "info"}}, false},
+		{"env key with equal sign", SpecMutation{Env: map[string]string{"A=B": "info"}}, false},
+		{"empty removed env key", SpecMutation{EnvRemove: []string{""}}, false},
+		{"removed env key with equal sign", SpecMutation{EnvRemove: []string{"A=B"}}, false},
+	}
+
+	for _, test := range tests {
+		err := test.mutation.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: mutation was accepted", test.name)
+		}
+	}
+}
+
+func TestSpecMutationCheck(t *testing.T) {
+	all := map[string]string{
+		LabelAllowEnv: "true", LabelAllowLabels: "true", LabelAllowSecrets: "true", LabelAllowConfigs: "true",
+	}
+
+	tests := []struct {
+		name     string
+		mutation SpecMutation
+		labels   map[string]string
+		valid    bool
+	}{
+		{"nothing", SpecMutation{}, nil, true},
+		{"env", SpecMutation{Env: map[string]string{"A": "1"}}, all, true},
+		{"env not allowed", SpecMutation{Env: map[string]string{"A": "1"}}, nil, false},
+		{"removed env not allowed", SpecMutation{EnvRemove: []string{"A"}}, nil, false},
+		{"label", SpecMutation{Labels: map[string]string{"traefik.enable": "true"}}, all, true},
+		{"label not allowed", SpecMutation{Labels: map[string]string{"traefik.enable": "true"}}, nil, false},
+		{"container label not allowed", SpecMutation{ContainerLabels: map[string]string{"app": "1"}}, nil, false},
+		{"whalepost label", SpecMutation{Labels: map[string]string{LabelAllowEnv: "true"}}, all, false},
+		{"removed whalepost label", SpecMutation{LabelsRemove: []string{LabelUpdateOriginal}}, all, false},
+		{"allow label", SpecMutation{Labels: map[string]string{LabelAllow: "true"}}, all, false},
+		{"stack label", SpecMutation{Labels: map[string]string{LabelStackNamespace: "team-b"}}, all, false},
+		{"removed stack label", SpecMutation{LabelsRemove: []string{LabelStackNamespace}}, all, false},
+		{"docker container label", SpecMutation{ContainerLabels: map[string]string{"com.docker.stack.namespace": "team-b"}}, all, false},
+		{"removed docker container label", SpecMutation{ContainerLabelsRemove: []string{"com.docker.swarm.service.name"}}, all, false},
+		{"secret", SpecMutation{Secrets: map[string]string{"key_v1": "key_v2"}}, all, true},
+		{"secret not allowed", SpecMutation{Secrets: map[string]string{"key_v1": "key_v2"}}, nil, false},
+		{"config", SpecMutation{Configs: map[string]string{"conf_v1": "conf_v2"}}, all, true},
+		{"config not allowed", SpecMutation{Configs: map[string]string{"conf_v1": "conf_v2"}}, nil, false},
+	}
+
+	for _, test := range tests {
+		err := test.mutation.Check(test.labels)
+		if test.valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("%s: mutation was accepted", test.name)
+		}
+	}
+}
+
+func TestSpecMutationApply(t *testing.T) {
+	tests := []struct {
+		name            string
+		mutation        SpecMutation
+		env             []string
+		labels          map[string]string
+		containerLabels map[string]string
+	}{
+		{"nothing", SpecMutation{}, []string{"A=1", "B=2"}, map[string]string{"app": "1"}, nil},
+		{"set env", SpecMutation{Env: map[string]string{"A": "3", "C": "x=y"}},
+			[]string{"A=3", "B=2", "C=x=y"}, map[string]string{"app": "1"}, nil},
+		{"remove env", SpecMutation{EnvRemove: []string{"A", "D"}},
+			[]string{"B=2"}, map[string]string{"app": "1"}, nil},
+		{"labels", SpecMutation{Labels: map[string]string{"version": "2"}, LabelsRemove: []string{"app"}},
+			[]string{"A=1", "B=2"}, map[string]string{"version": "2"}, nil},
+		{"container labels", SpecMutation{ContainerLabels: map[string]string{"app": "2"}},
+			[]string{"A=1", "B=2"}, map[string]string{"app": "1"}, map[string]string{"app": "2"}},
+	}
+
+	for _, test := range tests {
+		spec := swarm.ServiceSpec{
+			Annotations: swarm.Annotations{Labels: map[string]string{"app": "1"}},
+			TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{
+				Env: []string{"A=1", "B=2"},
+			}},
+		}
+
+		err := test.mutation.Apply(context.Background(), nil, &spec)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+			continue
+		}
+		if container := spec.TaskTemplate.ContainerSpec; !reflect.DeepEqual(container.Env, test.env) {
+			t.Errorf("%s: env = %v, want %v", test.name, container.Env, test.env)
+		}
+		if !reflect.DeepEqual(spec.Labels, test.labels) {
+			t.Errorf("%s: labels = %v, want %v", test.name, spec.Labels, test.labels)
+		}
+		if container := spec.TaskTemplate.ContainerSpec; !reflect.DeepEqual(container.Labels, test.containerLabels) {
+			t.Errorf("%s: container labels = %v, want %v", test.name, container.Labels, test.containerLabels)
+		}
+	}
+
+	// secrets and configs must be referenced by the service
+	spec := swarm.ServiceSpec{TaskTemplate: swarm.TaskSpec{ContainerSpec: &swarm.ContainerSpec{}}}
+	if err := (&SpecMutation{Secrets: map[string]string{"key_v1": "key_v2"}}).Apply(context.Background(), nil, &spec); err == nil {
+		t.Error("unreferenced secret was swapped")
+	}
+	if err := (&SpecMutation{Configs: map[string]string{"conf_v1": "conf_v2"}}).Apply(context.Background(), nil, &spec); err == nil {
+		t.Error("unreferenced config was swapped")
+	}
+
+	// services without a container cannot be mutated
+	if err := (&SpecMutation{}).Apply(context.Background(), nil, &swarm.ServiceSpec{}); err == nil {
+		t.Error("service without container spec was mutated")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	LabelUpdateParallelismMin = "whalepost.update.parallelism.min"
+	LabelUpdateParallelismMax = "whalepost.update.parallelism.max"
+	LabelUpdateDelayMax       = "whalepost.update.delay.max"
+	LabelUpdateMonitorMax     = "whalepost.update.monitor.max"
+	LabelUpdateRatioMax       = "whalepost.update.maxfailureratio.max"
+	LabelUpdateFailureActions = "whalepost.update.failureactions"
+	LabelUpdateOrders         = "whalepost.update.orders"
+	LabelUpdateOriginal       = "whalepost.update.original"
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// UpdateConfigOverride overrides the update config of a service for a single update.
+type UpdateConfigOverride struct {
+	Parallelism     *uint64  `json:"parallelism"`
+	Delay           string   `json:"delay"`
+	FailureAction   string   `json:"failureAction"`
+	Monitor         string   `json:"monitor"`
+	MaxFailureRatio *float32 `json:"maxFailureRatio"`
+	Order           string   `json:"order"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// Apply returns a copy of the update config with the override applied.
+// The limits configured by the service labels are enforced.
+func (o *UpdateConfigOverride) Apply(cfg *swarm.UpdateConfig, labels map[string]string) (*swarm.UpdateConfig, error) {
+	override := swarm.UpdateConfig{Parallelism: 1, FailureAction: swarm.UpdateFailureActionPause}
+	if cfg != nil {
+		override = *cfg
+	}
+
+	if o.Parallelism != nil {
+		min, err := parseUintLabel(labels, LabelUpdateParallelismMin, 0)
+		if err != nil {
+			return nil, err
+		}
+		max, err := parseUintLabel(labels, LabelUpdateParallelismMax, ^uint64(0))
+		if err != nil {
+			return nil, err
+		}
+		if *o.Parallelism < min || *o.Parallelism > max {
+			return nil, errors.Errorf("parallelism must be within [%d, %d]", min, max)
+		}
+		override.Parallelism = *o.Parallelism
+	}
+
+	if o.Delay != "" {
+		delay, err := parseDurationOverride(o.Delay, labels, LabelUpdateDelayMax)
+		if err != nil {
+			return nil, errors.Wrap(err, "delay")
+		}
+		override.Delay = delay
+	}
+
+	if o.Monitor != "" {
+		monitor, err := parseDurationOverride(o.Monitor, labels, LabelUpdateMonitorMax)
+		if err != nil {
+			return nil, errors.Wrap(err, "monitor")
+		}
+		override.Monitor = monitor
+	}
+
+	if o.MaxFailureRatio != nil {
+		max := float64(1)
+		if val, ok := labels[LabelUpdateRatioMax]; ok {
+			var err error
+			max, err = strconv.ParseFloat(val, 32)
+			if err != nil {
+				return nil, errors.Wrap(err, LabelUpdateRatioMax)
+			}
+		}
+		if *o.MaxFailureRatio < 0 || float64(*o.MaxFailureRatio) > max {
+			return nil, errors.Errorf("max failure ratio must be within [0, %g]", max)
+		}
+		override.MaxFailureRatio = *o.MaxFailureRatio
+	}
+
+	if o.FailureAction != "" {
+		allowed := []string{swarm.UpdateFailureActionPause,
+			swarm.UpdateFailureActionContinue, swarm.UpdateFailureActionRollback}
+		if !isOptionAllowed(o.FailureAction, allowed, labels[LabelUpdateFailureActions]) {
+			return nil, errors.Errorf("failure action \"%s\" not allowed", o.FailureAction)
+		}
+		override.FailureAction = o.FailureAction
+	}
+
+	if o.Order != "" {
+		allowed := []string{swarm.UpdateOrderStopFirst, swarm.UpdateOrderStartFirst}
+		if !isOptionAllowed(o.Order, allowed, labels[LabelUpdateOrders]) {
+			return nil, errors.Errorf("order \"%s\" not allowed", o.Order)
+		}
+		override.Order = o.Order
+	}
+
+	return &override, nil
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// saveUpdateConfig remembers the original update config in the labels of
+// the spec, so that it can be restored once the update has converged.
+func saveUpdateConfig(spec *swarm.ServiceSpec, cfg *swarm.UpdateConfig) error {
+	buf, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	if spec.Labels == nil {
+		spec.Labels = make(map[string]string)
+	}
+	spec.Labels[LabelUpdateOriginal] = string(buf)
+
+	return nil
+}
+
+// restoreUpdateConfig puts the update config saved by an earlier override
+// back into the spec. Specs without a saved update config are left untouched.
+func restoreUpdateConfig(spec *swarm.ServiceSpec) error {
+	val, ok := spec.Labels[LabelUpdateOriginal]
+	if !ok {
+		return nil
+	}
+
+	var cfg *swarm.UpdateConfig
+	err := json.Unmarshal([]byte(val), &cfg)
+	if err != nil {
+		return errors.Wrap(err, LabelUpdateOriginal)
+	}
+
+	spec.UpdateConfig = cfg
+	delete(spec.Labels, LabelUpdateOriginal)
+
+	return nil
+}
+
+// restoreAfterRollout puts the original update config back once the update
+// which overrode it has converged. The caller has to hold the lock of the
+// service. The label stays as fallback for the next update when the spec has
+// been changed by someone else in the meantime or the restore fails.
+func restoreAfterRollout(ctx context.Context, log *logrus.Entry, docker *client.Client, serviceId string, overridden *swarm.ServiceSpec) {
+	service, _, err := docker.ServiceInspectWithRaw(ctx, serviceId, types.ServiceInspectOptions{})
+	if err != nil {
+		log.Warnln("failed to restore update config:", err.Error())
+		return
+	}
+
+	current, _ := json.Marshal(&service.Spec)
+	expected, _ := json.Marshal(overridden)
+	if !bytes.Equal(current, expected) {
+		log.Warnln("keeping overridden update config: service has been changed during the rollout")
+		return
+	}
+
+	err = restoreUpdateConfig(&service.Spec)
+	if err != nil {
+		log.Warnln("failed to restore update config:", err.Error())
+		return
+	}
+
+	_, err = docker.ServiceUpdate(ctx, service.ID, service.Version, service.Spec, types.ServiceUpdateOptions{})
+	if err != nil {
+		log.Warnln("failed to restore update config:", err.Error())
+		return
+	}
+
+	log.Infoln("restored the original update config")
+}
+
+// parseUintLabel parses the label as an unsigned integer.
+func parseUintLabel(labels map[string]string, key string, def uint64) (uint64, error) {
+	val, ok := labels[key]
+	if !ok {
+		return def, nil
+	}
+
+	num, err := strconv.ParseUint(val, 10, 64)
+	if err != nil {
+		return 0, errors.Wrap(err, key)
+	}
+
+	return num, nil
+}
+
+// parseDurationOverride parses the duration and makes sure it
+// does not exceed the limit configured by the label.
+func parseDurationOverride(val string, labels map[string]string, key string) (time.Duration, error) {
+	duration, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, err
+	}
+	if duration < 0 {
+		return 0, errors.New("must not be negative")
+	}
+
+	if limit, ok := labels[key]; ok {
+		max, err := time.ParseDuration(limit)
+		if err != nil {
+			return 0, errors.Wrap(err, key)
+		}
+		if duration > max {
+			return 0, errors.Errorf("must not exceed %s", max)
+		}
+	}
+
+	return duration, nil
+}
+
+// isOptionAllowed checks that the option is valid and contained
+// in the comma separated list of allowed values, if present.
+func isOptionAllowed(option string, valid []string, allowed string) bool {
+	if !containsString(valid, option) {
+		return false
+	}
+
+	if allowed == "" {
+		return true
+	}
+
+	return containsString(strings.Split(allowed, ","), option)
+}
+
+// containsString returns true if the slice contains the string.
+func containsString(slice []string, str string) bool {
+	for _, s := range slice {
+		if strings.TrimSpace(s) == str {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,337 @@
+package main
+
+// whalepost
+// Copyright (C) 2018 Maximilian Pachl
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// ---------------------------------------------------------------------------------------
+//  imports
+// ---------------------------------------------------------------------------------------
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ---------------------------------------------------------------------------------------
+//  constants
+// ---------------------------------------------------------------------------------------
+
+const (
+	LabelWindow = "whalepost.window"
+
+	WindowModeReject = "reject"
+	WindowModeQueue  = "queue"
+
+	windowTzPrefix = "CRON_TZ="
+)
+
+// ---------------------------------------------------------------------------------------
+//  types
+// ---------------------------------------------------------------------------------------
+
+// Window is a set of cron schedules during which deployments are allowed.
+type Window struct {
+	schedules []*Schedule
+	location  *time.Location
+}
+
+// WindowError is returned when a deployment is requested outside
+// of the deployment window or during a freeze.
+type WindowError struct {
+	*HttpError
+	Opens time.Time
+}
+
+// queuedDeploy is a deployment waiting for the window to open.
+type queuedDeploy struct {
+	deployment string
+	frozen     bool
+	cancel     chan struct{}
+}
+
+// QueuedResponse is returned when a deployment has been queued until the window opens.
+type QueuedResponse struct {
+	Status     string    `json:"status"`
+	Deployment string    `json:"deployment"`
+	Opens      time.Time `json:"opens"`
+}
+
+// ---------------------------------------------------------------------------------------
+//  global variables
+// ---------------------------------------------------------------------------------------
+
+var (
+	// queued deployments by service name, only the latest request is kept
+	queued      = make(map[string]*queuedDeploy)
+	queuedMutex sync.Mutex
+)
+
+// ---------------------------------------------------------------------------------------
+//  public functions
+// ---------------------------------------------------------------------------------------
+
+// ParseWindow parses a window like "CRON_TZ=Europe/Berlin * 8-15 * * mon-thu; * 8-11 * * fri".
+// Each schedule matches the minutes in which deployments are allowed.
+func ParseWindow(expr string) (*Window, error) {
+	window := Window{location: time.Local}
+
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, windowTzPrefix) {
+		fields := strings.SplitN(expr, " ", 2)
+		loc, err := time.LoadLocation(strings.TrimPrefix(fields[0], windowTzPrefix))
+		if err != nil {
+			return nil, err
+		}
+		window.location = loc
+
+		expr = ""
+		if len(fields) > 1 {
+			expr = fields[1]
+		}
+	}
+
+	for _, rule := range strings.Split(expr, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+
+		schedule, err := ParseSchedule(rule)
+		if err != nil {
+			return nil, err
+		}
+		window.schedules = append(window.schedules, schedule)
+	}
+
+	if len(window.schedules) == 0 {
+		return nil, errors.New("window: no schedule given")
+	}
+
+	return &window, nil
+}
+
+// IsOpen returns true if deployments are allowed at t.
+func (w *Window) IsOpen(t time.Time) bool {
+	t = t.In(w.location)
+	for _, schedule := range w.schedules {
+		if schedule.Match(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Opens returns the next time the window opens after t.
+func (w *Window) Opens(t time.Time) time.Time {
+	var opens time.Time
+	for _, schedule := range w.schedules {
+		next := schedule.Next(t.In(w.location))
+		if !next.IsZero() && (opens.IsZero() || next.Before(opens)) {
+			opens = next
+		}
+	}
+
+	return opens
+}
+
+// CheckWindow makes sure that the service may be deployed at t.
+// A *WindowError is returned during a freeze or outside of the window.
+func CheckWindow(labels map[string]string, t time.Time) error {
+	// a freeze blocks everything
+	if freeze := GetFreeze(); freeze != nil {
+		return &WindowError{
+			HttpError: NewHttpError(http.StatusLocked, CodeDeploymentsFrozen, "deployments are frozen: "+freeze.Reason),
+			Opens:     freeze.Until,
+		}
+	}
+
+	// the window of the service takes precedence over the global one
+	window := GlobalWindow
+	if expr, ok := labels[LabelWindow]; ok {
+		var err error
+		window, err = ParseWindow(expr)
+		if err != nil {
+			return NewHttpError(http.StatusUnprocessableEntity, CodeInvalidLabel, LabelWindow+": "+err.Error())
+		}
+	}
+
+	if window == nil || window.IsOpen(t) {
+		return nil
+	}
+
+	opens := window.Opens(t)
+	return &WindowError{
+		HttpError: NewHttpError(http.StatusLocked, CodeWindowClosed,
+			fmt.Sprintf("outside of deployment window, opens at %s", opens.Format(time.RFC3339))),
+		Opens: opens,
+	}
+}
+
+// ---------------------------------------------------------------------------------------
+//  private functions
+// ---------------------------------------------------------------------------------------
+
+// checkWindowAllowed makes sure that the service may be modified now, unless
+// an admin overrides the deployment windows with the request.
+func checkWindowAllowed(r *http.Request, log *logrus.Entry, labels map[string]string) error {
+	override, err := checkOverride(r, log)
+	if err != nil || override {
+		return err
+	}
+
+	err = CheckWindow(labels, time.Now())
+	if err != nil {
+		log.Errorln("rejecting request:", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// queueDeploy deploys the service as soon as the window opens.
+// A queued deployment of the same service is cancelled.
+func queueDeploy(log *logrus.Entry, docker *client.Client, serviceId string, body *UpdateBody, e *WindowError) error {
+	d, ok := GetDeployment(body.DeploymentId)
+	if !ok {
+		log.Errorln("failed to queue deployment: deployment not found")
+		return NewHttpError(http.StatusNotFound, CodeDeploymentNotFound, "deployment not found")
+	}
+
+	q := &queuedDeploy{
+		deployment: body.DeploymentId,
+		frozen:     e.Code == CodeDeploymentsFrozen,
+		cancel:     make(chan struct{}),
+	}
+
+	queuedMutex.Lock()
+	if prev, ok := queued[d.Service]; ok && prev.deployment != q.deployment {
+		prev.stop("superseded by " + q.deployment)
+	}
+	queued[d.Service] = q
+	queuedMutex.Unlock()
+
+	opens := e.Opens
+	log.Infof("deployment queued until %s", opens.Format(time.RFC3339))
+	UpdateDeployment(body.DeploymentId, func(d *Deployment) {
+		d.State = DeploymentQueued
+		d.Finished = nil
+		d.Error = ""
+	})
+
+	go func() {
+		for !opens.IsZero() {
+			timer := time.NewTimer(time.Until(opens))
+			select {
+			case <-q.cancel:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			// the deployment might have been cancelled in the meantime
+			if !dequeueDeploy(d.Service, q) {
+				return
+			}
+
+			_, err := Deploy(context.Background(), log, docker, serviceId, body)
+			if e, ok := err.(*WindowError); ok {
+				opens = e.Opens
+				if !requeueDeploy(d.Service, q, e) {
+					return
+				}
+				log.Infof("deployment still blocked, requeued until %s", opens.Format(time.RFC3339))
+				continue
+			} else if err != nil {
+				log.Errorln("queued deployment failed:", err.Error())
+			}
+			return
+		}
+
+		log.Errorln("dropping queued deployment: window never opens")
+		dequeueDeploy(d.Service, q)
+		finishDeployment(body.DeploymentId, nil, e)
+	}()
+
+	return nil
+}
+
+// cancelFrozenDeploys cancels all deployments queued by a freeze.
+func cancelFrozenDeploys(reason string) {
+	queuedMutex.Lock()
+	defer queuedMutex.Unlock()
+
+	for service, q := range queued {
+		if q.frozen {
+			q.stop(reason)
+			delete(queued, service)
+		}
+	}
+}
+
+// dequeueDeploy forgets the queued deployment of the service.
+// False is returned if q is not queued anymore.
+func dequeueDeploy(service string, q *queuedDeploy) bool {
+	queuedMutex.Lock()
+	defer queuedMutex.Unlock()
+
+	if queued[service] != q {
+		return false
+	}
+
+	delete(queued, service)
+	return true
+}
+
+// requeueDeploy queues q again after it has been blocked by e.
+// False is returned if a newer deployment of the service has been queued meanwhile.
+func requeueDeploy(service string, q *queuedDeploy, e *WindowError) bool {
+	queuedMutex.Lock()
+	defer queuedMutex.Unlock()
+
+	if newer, ok := queued[service]; ok {
+		q.stop("superseded by " + newer.deployment)
+		return false
+	}
+
+	q.frozen = e.Code == CodeDeploymentsFrozen
+	queued[service] = q
+	return true
+}
+
+// stop cancels the queued deployment. The caller must hold the queue lock.
+func (q *queuedDeploy) stop(reason string) {
+	close(q.cancel)
+
+	var progress Progress
+	found := UpdateDeployment(q.deployment, func(d *Deployment) {
+		now := time.Now()
+		d.State = DeploymentCancelled
+		d.Finished = &now
+		d.Error = reason
+		progress = d.ResultProgress()
+	})
+	if found {
+		Publish(progress)
+	}
+}